@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+//cpuTime 进程已使用的cpu时间
+func cpuTime() time.Duration {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return 0
+	}
+	//Filetime 以100纳秒为单位
+	k := int64(kernel.HighDateTime)<<32 | int64(kernel.LowDateTime)
+	u := int64(user.HighDateTime)<<32 | int64(user.LowDateTime)
+	return time.Duration((k + u) * 100)
+}
@@ -41,6 +41,8 @@ func main() {
 	}
 	app.RunAssembly(s)
 	s.Subscribe(ChannelRpl, pong)
+	time.Sleep(time.Second)
+	fmt.Printf("负载前空闲cpu:%5.2f%%\n", idleCPU(s))
 	lose := 0
 	loop := 200  //20000
 	gNum := 1000 //1000
@@ -72,6 +74,7 @@ func main() {
 	end := time.Now()
 	qps := float64(loop*gNum) / end.Sub(start).Seconds()
 	fmt.Printf("1个Node运行%d个协程Call:%6.0f   lose:%d\n", gNum, qps, lose)
+	fmt.Printf("负载后空闲cpu:%5.2f%%\n", idleCPU(s))
 	//num个节点
 	num := 100 //1000
 	for i := 0; i < num; i++ {
@@ -122,6 +125,18 @@ func main() {
 	app.Guard()
 }
 
+//idleCPU 空闲1秒，返回进程cpu占用（单核百分比），并输出Serial被唤醒的次数。
+//原10微秒轮询时Serial每秒唤醒约100000次，休眠后空闲时接近0。
+func idleCPU(s *domi.Serial) float64 {
+	wakeups := s.Wakeups()
+	cpu := cpuTime()
+	start := time.Now()
+	time.Sleep(time.Second)
+	used := cpuTime() - cpu
+	fmt.Printf("Serial空闲1秒唤醒次数:%d\n", s.Wakeups()-wakeups)
+	return 100 * used.Seconds() / time.Since(start).Seconds()
+}
+
 func pong(ctx *domi.ContextMQ) {
 	clientNwg.Done()
 }
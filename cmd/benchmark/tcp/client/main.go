@@ -45,7 +45,7 @@ func clientN(num int) {
 	cs := make([]*transport.ClientTCP, num)
 	for i := 0; i < num; i++ {
 		k := i
-		cs[i], err = transport.NewClientTCP(context.TODO(), "127.0.0.1:4567", h, sd, nil, &cbc)
+		cs[i], err = transport.NewClientTCP(context.TODO(), "127.0.0.1:4567", h, sd, nil, &cbc, nil)
 		if err != nil {
 			fmt.Println("连接服务端失败:", err.Error())
 			os.Exit(1)
@@ -16,7 +16,7 @@ func main() {
 	h := transport.NewHandler()
 	sd := util.NewDispatcher(256)
 	go sd.Run()
-	s := transport.NewServerTCP(a.Ctx, ":4567", h, sd, nil, &cbc)
+	s := transport.NewServerTCP(a.Ctx, ":4567", h, sd, nil, &cbc, nil)
 	h.HandleFunc(224, ping)
 	if s == nil {
 		log.Fatalln("启动tcp服务失败。")
@@ -0,0 +1,111 @@
+package domi
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//ErrNotDeadLetter 定义错误
+var ErrNotDeadLetter = errors.New("domi.Replay|请求不是死信。")
+
+//maxDeadLetterReason 失败原因的最大长度
+const maxDeadLetterReason = 255 - 4
+
+//deadLetterTable 死信频道配置
+type deadLetterTable struct {
+	mutex    sync.RWMutex
+	channels map[uint16]uint16 //频道 -> 死信频道
+	node     int               //节点默认的死信频道，-1 无
+}
+
+func newDeadLetterTable() *deadLetterTable {
+	return &deadLetterTable{
+		channels: make(map[uint16]uint16, 16),
+		node:     -1,
+	}
+}
+
+//get 取得频道的死信频道，未设置时使用节点默认的死信频道。
+func (dt *deadLetterTable) get(channel uint16) (uint16, bool) {
+	dt.mutex.RLock()
+	defer dt.mutex.RUnlock()
+	if dead, ok := dt.channels[channel]; ok {
+		return dead, true
+	}
+	if dt.node >= 0 && uint16(dt.node) != channel {
+		return uint16(dt.node), true
+	}
+	return 0, false
+}
+
+//SetDeadLetter 设置频道的死信频道，发送失败（无订阅者、熔断、ErrFailureBusy、超时）或本节点处理函数异常的消息，
+//连同失败原因发往死信频道。
+func (n *Node) SetDeadLetter(channel, dead uint16) {
+	n.deadLetters.mutex.Lock()
+	n.deadLetters.channels[channel] = dead
+	n.deadLetters.mutex.Unlock()
+}
+
+//SetNodeDeadLetter 设置节点默认的死信频道，作用于未单独设置的频道。
+func (n *Node) SetNodeDeadLetter(dead uint16) {
+	n.deadLetters.mutex.Lock()
+	n.deadLetters.node = int(dead)
+	n.deadLetters.mutex.Unlock()
+}
+
+//deadLetterReject 发送失败时将原始帧发往死信频道，再调用reject。
+func (n *Node) deadLetterReject(channel uint16, fs transport.FrameSlice, reject func(error)) func(error) {
+	dead, ok := n.deadLetters.get(channel)
+	if !ok {
+		return reject
+	}
+	return func(err error) {
+		n.sendDeadLetter(dead, channel, fs.GetData(), fs.GetExtend(), err.Error())
+		reject(err)
+	}
+}
+
+//sendDeadLetter 发往死信频道，失败时只记录日志。
+func (n *Node) sendDeadLetter(dead, channel uint16, data, ex []byte, reason string) {
+	if len(reason) > maxDeadLetterReason {
+		reason = reason[:maxDeadLetterReason]
+	}
+	v := make([]byte, 4+len(reason))
+	util.CopyUint16(v[:2], channel)
+	util.CopyUint16(v[2:4], uint16(n.sidecar.MachineID))
+	copy(v[4:], reason)
+	fs := transport.NewFrameSlice(dead, data, appendExtend(removeExtend(ex, extendDeadLetter), extendDeadLetter, v))
+	n.sidecar.AskOne(dead, fs, func(err error) {
+		n.Logger.Error("sendDeadLetter|死信发送失败：", channel, " ", err.Error())
+	})
+}
+
+//DeadLetter 死信的原频道、产生死信的机器id及失败原因，不是死信时ok为false。
+func (c *ContextMQ) DeadLetter() (channel, from uint16, reason string, ok bool) {
+	v := getExtend(c.ex, extendDeadLetter)
+	if len(v) < 4 {
+		return 0, 0, "", false
+	}
+	return util.BytesToUint16(v[:2]), util.BytesToUint16(v[2:4]), string(v[4:]), true
+}
+
+//Replay 将死信重新发往原频道
+func (c *ContextMQ) Replay(reject func(error)) {
+	v := getExtend(c.ex, extendDeadLetter)
+	if len(v) < 4 {
+		reject(ErrNotDeadLetter)
+		return
+	}
+	channel := util.BytesToUint16(v[:2])
+	//去除可靠投递的消息id，避免被接收方去重。
+	ex := removeExtend(removeExtend(c.ex, extendDeadLetter), extendAck)
+	fs := transport.NewFrameSlice(channel, c.Request, ex)
+	if topic := getExtend(ex, extendTopic); channel == transport.FrameTypeTopic && len(topic) > 0 {
+		c.sidecar.AskTopicOne(string(topic), fs, reject)
+		return
+	}
+	c.sidecar.AskOne(channel, fs, c.deadLetterReject(channel, fs, reject))
+}
@@ -0,0 +1,180 @@
+package domi
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//durableRetainDuration 按时间保留的检查间隔
+const durableRetainDuration = time.Minute
+
+//Durable 持久化频道的订阅，收到的消息先写入本地预写日志，再按偏移量交给处理函数。
+type Durable struct {
+	n        *Node
+	channel  uint16
+	consumer string
+	wal      *util.WAL
+	f        func(*ContextMQ)
+
+	signal    chan struct{}
+	stopChan  chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+//SubscribeDurable 订阅持久化频道，consumer为消费者名称，重启后从其最后提交的偏移量继续处理。
+//处理函数返回后自动提交偏移量；可靠投递（NotifyReliable）的消息在写入日志后即确认。
+//写入日志失败时记录日志，可靠投递的消息不确认，由发送方重发，其它消息发往死信频道。
+func (n *Node) SubscribeDurable(channel uint16, consumer string, wc util.WALConfigure, f func(*ContextMQ)) (*Durable, error) {
+	if err := n.claimChannel(channel, n); err != nil {
+		return nil, err
+	}
+	wal, err := util.OpenWAL(wc)
+	if err != nil {
+		n.releaseChannel(channel, n)
+		return nil, err
+	}
+	if _, err := wal.Committed(consumer); err != nil {
+		n.releaseChannel(channel, n)
+		wal.Close()
+		return nil, err
+	}
+	d := &Durable{
+		n:        n,
+		channel:  channel,
+		consumer: consumer,
+		wal:      wal,
+		f:        f,
+		signal:   make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go d.run()
+	n.sidecar.HandleFunc(channel, d.durableWrapper)
+	n.sidecar.SetChannel(uint16(n.sidecar.MachineID), channel, 3)
+	return d, nil
+}
+
+//durableWrapper 写入日志，写入失败不返回错误，避免断开连接。
+func (d *Durable) durableWrapper(s transport.Session) error {
+	fs := s.GetFrameSlice()
+	v := getExtend(fs.GetExtend(), extendAck)
+	if len(v) == 11 && d.n.duplicate(v) {
+		d.n.sendAck(v, d.logError)
+		return nil
+	}
+	if _, err := d.wal.Append(fs.GetAll()); err != nil {
+		d.logError(err)
+		//可靠投递的消息不确认，等待重发。
+		if len(v) != 11 {
+			if dead, ok := d.n.deadLetters.get(d.channel); ok {
+				d.n.sendDeadLetter(dead, d.channel, fs.GetData(), fs.GetExtend(), err.Error())
+			}
+		}
+		return nil
+	}
+	if len(v) == 11 {
+		d.n.markAcked(v)
+		d.n.sendAck(v, d.logError)
+	}
+	select {
+	case d.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (d *Durable) logError(err error) {
+	d.n.Logger.Error("Durable|", err.Error())
+}
+
+//run 从最后提交的偏移量开始按序处理
+func (d *Durable) run() {
+	defer func() {
+		d.wal.Close()
+		d.wg.Done()
+	}()
+	retain := time.NewTicker(durableRetainDuration)
+	defer retain.Stop()
+	offset, _ := d.wal.Committed(d.consumer)
+	for {
+		first, next := d.wal.Offsets()
+		//已被删除的记录跳过
+		if offset < first {
+			offset = first
+		}
+		if offset < next {
+			data, err := d.wal.Read(offset)
+			if err != nil {
+				d.logError(err)
+			} else {
+				d.process(data)
+			}
+			offset++
+			if err := d.wal.Commit(d.consumer, offset); err != nil {
+				d.logError(err)
+			}
+			continue
+		}
+		select {
+		case <-d.signal:
+		case <-retain.C:
+			d.wal.Retain()
+		case <-d.n.Ctx.Done():
+			d.stop()
+			return
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+//process 调用处理函数
+func (d *Durable) process(data []byte) {
+	fs := transport.DecodeByBytes(data)
+	defer func() {
+		if r := recover(); r != nil {
+			d.n.Logger.Error("Durable|异常频道：", d.channel)
+			d.n.Logger.Error("Durable|异常拦截：", r, string(debug.Stack()))
+			if dead, ok := d.n.deadLetters.get(d.channel); ok {
+				d.n.sendDeadLetter(dead, d.channel, fs.GetData(), fs.GetExtend(), fmt.Sprint("panic: ", r))
+			}
+		}
+	}()
+	d.f(&ContextMQ{
+		Node:    d.n,
+		Request: fs.GetData(),
+		ex:      fs.GetExtend(),
+	})
+}
+
+//Offsets 日志中最早一条记录的偏移量及下一条写入的偏移量
+func (d *Durable) Offsets() (uint64, uint64) {
+	return d.wal.Offsets()
+}
+
+//Committed 消费者已提交的偏移量
+func (d *Durable) Committed() (uint64, error) {
+	return d.wal.Committed(d.consumer)
+}
+
+//Close 退订频道（节点已退出时不退订），阻塞至处理中的消息完成、日志关闭。
+func (d *Durable) Close() {
+	d.stop()
+	d.wg.Wait()
+}
+
+//stop 节点退出时不再退订，避免关闭中向sidecar发送。
+func (d *Durable) stop() {
+	d.closeOnce.Do(func() {
+		if d.n.Ctx.Err() == nil {
+			d.n.Unsubscribe(d.channel)
+		}
+		close(d.stopChan)
+	})
+}
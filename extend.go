@@ -0,0 +1,71 @@
+package domi
+
+/*
+扩展（extend）由若干字段组成，每个字段：
+  [x]         [x]         [x]...
+|(uint8)  ||(uint8)  || (binary)...
+| 1-byte  || 1-byte  ||  N-byte
+--------------------------------------
+  类型        长度         值
+*/
+
+//定义扩展字段类型
+const (
+	extendReply      uint8 = 1 + iota //Call的回复地址：2字节机器id、2字节频道
+	extendRequest                     //Request的请求id：2字节机器id、8字节请求id
+	extendKey                         //路由键：不超过255字节
+	extendPipeline                    //pipeline路由：见pipeline.go
+	extendAck                         //可靠投递：2字节机器id、8字节消息id、1字节投递次数
+	extendDeadLetter                  //死信：2字节原频道、2字节机器id、失败原因
+	extendTopic                       //主题：不超过255字节
+	extendStream                      //流：见stream.go
+)
+
+//getExtend 读取类型为kind的字段，不存在时返回nil。
+func getExtend(ex []byte, kind uint8) []byte {
+	for len(ex) >= 2 {
+		l := int(ex[1]) + 2
+		if l > len(ex) {
+			return nil
+		}
+		if ex[0] == kind {
+			return ex[2:l]
+		}
+		ex = ex[l:]
+	}
+	return nil
+}
+
+//validExtend ex由已定义类型的字段组成，且长度恰好用完。
+func validExtend(ex []byte) bool {
+	for len(ex) >= 2 {
+		l := int(ex[1]) + 2
+		if l > len(ex) || ex[0] < extendReply || ex[0] > extendStream {
+			return false
+		}
+		ex = ex[l:]
+	}
+	return len(ex) == 0
+}
+
+//appendExtend 追加类型为kind的字段，v长度不得超过255。
+func appendExtend(ex []byte, kind uint8, v []byte) []byte {
+	ex = append(ex, kind, uint8(len(v)))
+	return append(ex, v...)
+}
+
+//removeExtend 移除类型为kind的字段，返回新的切片。
+func removeExtend(ex []byte, kind uint8) []byte {
+	r := make([]byte, 0, len(ex))
+	for len(ex) >= 2 {
+		l := int(ex[1]) + 2
+		if l > len(ex) {
+			break
+		}
+		if ex[0] != kind {
+			r = append(r, ex[:l]...)
+		}
+		ex = ex[l:]
+	}
+	return r
+}
@@ -0,0 +1,153 @@
+package domi
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//定义错误
+var (
+	ErrGatherNone   = errors.New("domi.Gather|没有节点收到请求。")
+	ErrGatherQuorum = errors.New("domi.Gather|发送失败的节点过多，无法达到法定数量。")
+)
+
+//Reply 回复
+type Reply struct {
+	From uint16 //回复节点的机器id
+	Data []byte
+}
+
+//GatherOption 法定数量，由发送请求的节点数计算需要的回复数。
+type GatherOption func(sent int) int
+
+//GatherAll 等待所有发送请求的节点回复，默认。
+func GatherAll() GatherOption {
+	return func(sent int) int { return sent }
+}
+
+//GatherFirst 收到n个回复即返回
+func GatherFirst(n int) GatherOption {
+	return func(sent int) int {
+		if n < sent {
+			return n
+		}
+		return sent
+	}
+}
+
+//GatherMajority 收到过半节点的回复即返回
+func GatherMajority() GatherOption {
+	return func(sent int) int { return sent/2 + 1 }
+}
+
+//gatherCall 等待多个回复的请求
+type gatherCall struct {
+	mutex   sync.Mutex
+	replies []Reply
+	sent    int          //发送请求的节点数，-1 发送未完成
+	lost    map[int]bool //发送失败的目标，同一目标只计一次
+	quorum  GatherOption
+	err     error
+	done    chan struct{}
+	closed  bool
+}
+
+//add 加入回复，同一节点只取第一个。
+func (g *gatherCall) add(r Reply) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.closed {
+		return
+	}
+	for _, v := range g.replies {
+		if v.From == r.From {
+			return
+		}
+	}
+	g.replies = append(g.replies, r)
+	g.check()
+}
+
+//setSent 发送完成，sent为尝试发送的节点数。
+func (g *gatherCall) setSent(sent int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.sent = sent
+	g.check()
+}
+
+//failed 发往目标失败的回调，可能先于setSent，也可能在发送后超时时调用。
+func (g *gatherCall) failed(target int) func(error) {
+	return func(error) {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		if target < 0 || g.lost[target] {
+			return
+		}
+		g.lost[target] = true
+		g.check()
+	}
+}
+
+//check 达到法定数量时完成，失败的节点过多无法达到时以ErrGatherQuorum完成，需持有锁。
+func (g *gatherCall) check() {
+	if g.closed || g.sent < 0 {
+		return
+	}
+	need := g.quorum(g.sent)
+	switch {
+	case len(g.replies) >= need:
+	case len(g.replies)+len(g.lost) >= g.sent:
+		g.err = ErrGatherQuorum
+	default:
+		return
+	}
+	g.closed = true
+	close(g.done)
+}
+
+//result 取得已收到的回复
+func (g *gatherCall) result() []Reply {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.closed = true
+	return g.replies
+}
+
+//Gather 发往所有订阅频道的节点并收集回复，阻塞至达到法定数量（默认全部），
+//或ctx超时、取消，此时返回已收到的回复及ctx.Err()。法定数量按发送的节点数计算，
+//发送失败的节点过多无法达到时返回已收到的回复及ErrGatherQuorum。
+func (n *Node) Gather(ctx context.Context, channel uint16, data []byte, quorum ...GatherOption) ([]Reply, error) {
+	g := &gatherCall{
+		sent:   -1,
+		lost:   make(map[int]bool, 4),
+		quorum: GatherAll(),
+		done:   make(chan struct{}),
+	}
+	if len(quorum) > 0 && quorum[0] != nil {
+		g.quorum = quorum[0]
+	}
+	id := n.requests.addGather(g)
+	defer n.requests.removeGather(id)
+	v := make([]byte, 10)
+	util.CopyUint16(v[:2], uint16(n.sidecar.MachineID))
+	util.CopyInt64(v[2:10], int64(id))
+	fs := transport.NewFrameSlice(channel, data, appendExtend(nil, extendRequest, v))
+	sent := n.sidecar.AskAllEach(channel, fs, g.failed)
+	if sent == 0 {
+		return nil, ErrGatherNone
+	}
+	g.setSent(sent)
+	select {
+	case <-g.done:
+		return g.result(), g.err
+	case <-ctx.Done():
+		return g.result(), ctx.Err()
+	case <-n.Ctx.Done():
+		return g.result(), ErrRequestClosed
+	}
+}
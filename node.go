@@ -3,7 +3,9 @@ package domi
 import (
 	"context"
 	"errors"
+	"fmt"
 	"runtime/debug"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -18,22 +20,58 @@ type Node struct {
 	Ctx                          context.Context
 	ExitFunc                     func()
 	Name, HTTPPort, TCPPort      string
-	Endpoints                    []string //etcd 地址
-	util.LimiterConfigure                 //限流器配置
-	util.CircuitBreakerConfigure          //熔断器配置
+	Endpoints                    []string                     //etcd 地址
+	Distributer                  sidecar.Distributer          //分布式键值对存储，nil时使用Endpoints连接etcd
+	util.LimiterConfigure                                     //限流器配置
+	util.CircuitBreakerConfigure                              //熔断器配置
+	Security                     *transport.SecurityConfigure //安全配置，nil时节点间明文传输
+	Admin                        *sidecar.AdminConfigure      //管理接口配置，nil时禁止通过http关闭节点
+	Reliable                     ReliableConfigure            //可靠投递配置
+	Schedule                     ScheduleConfigure            //定时消息配置
 	Logger                       *util.Logger
+
+	requests    *requestTable    //等待回复的请求
+	reliable    *reliableTable   //可靠投递
+	deadLetters *deadLetterTable //死信频道
+	scheduler   *scheduler       //定时消息
+	topics      *topicTable      //本节点订阅的主题
+	streams     *streamTable     //节点间的流
+
+	ownerMutex sync.Mutex
+	owners     map[uint16]interface{} //频道的处理者，*Node、*Serial或流
 }
 
 //Run 运行
 func (n *Node) Run() {
+	go n.schedule()
 	n.sidecar.Run()
 }
 
 //Init 初始化
 func (n *Node) Init() {
-	n.sidecar = sidecar.NewSidecar(n.Ctx, n.ExitFunc, n.Name, n.HTTPPort, n.TCPPort, n.Endpoints, &n.LimiterConfigure, &n.CircuitBreakerConfigure)
+	var operation interface{} = n.Endpoints
+	if n.Distributer != nil {
+		operation = n.Distributer
+	}
+	n.sidecar = sidecar.NewSidecar(n.Ctx, n.ExitFunc, n.Name, n.HTTPPort, n.TCPPort, operation, &n.LimiterConfigure, &n.CircuitBreakerConfigure, n.Security, n.Admin)
 	n.Logger = n.sidecar.Logger
 	n.Logger.SetLevel(util.ErrorLevel)
+	n.requests = newRequestTable()
+	n.owners = make(map[uint16]interface{}, 64)
+	n.sidecar.HandleFunc(transport.FrameTypeReply, n.replyWrapper)
+	n.reliable = newReliableTable(n.Reliable)
+	n.sidecar.HandleFunc(transport.FrameTypeAck, n.ackWrapper)
+	n.deadLetters = newDeadLetterTable()
+	n.topics = newTopicTable()
+	n.sidecar.HandleFunc(transport.FrameTypeTopic, n.topicWrapper)
+	n.streams = newStreamTable()
+	n.sidecar.HandleFunc(transport.FrameTypeStream, n.streamWrapper)
+	n.scheduler = newScheduler(n.Schedule)
+	if n.Schedule.WAL != nil {
+		if err := n.openSchedule(); err != nil {
+			n.Logger.Error("Init|定时消息日志打开失败：", err.Error())
+		}
+	}
 }
 
 //WaitInit 阻塞，等待Run初始化完成
@@ -58,6 +96,11 @@ func (n *Node) IsWorking() bool {
 	return n.sidecar.GetState() == util.StateWork
 }
 
+//LinkEvents 与其它节点的连接断开、恢复事件
+func (n *Node) LinkEvents() <-chan sidecar.LinkEvent {
+	return n.sidecar.LinkEvents()
+}
+
 type channelWrapper struct {
 	n  *Node
 	cc chan []byte
@@ -73,8 +116,11 @@ func (n *Node) WatchChannel(channel uint16, cc chan []byte) {
 		n:  n,
 		cc: cc,
 	}
+	if err := n.handleChannel(channel, n, cs.watchChannelWrapper); err != nil {
+		n.Logger.Error("WatchChannel|", err.Error(), channel)
+		return
+	}
 	n.sidecar.SetChannel(uint16(n.sidecar.MachineID), channel, 3)
-	n.sidecar.HandleFunc(channel, cs.watchChannelWrapper)
 }
 
 func (wcs channelWrapper) watchChannelWrapper(s transport.Session) error {
@@ -96,56 +142,168 @@ func (n *Node) Subscribe(channel uint16, f func(*ContextMQ)) {
 		n: n,
 		f: f,
 	}
-	n.sidecar.HandleFunc(channel, pw.processWrapper)
+	if err := n.handleChannel(channel, n, pw.processWrapper); err != nil {
+		n.Logger.Error("Subscribe|", err.Error(), channel)
+		return
+	}
 	n.sidecar.SetChannel(uint16(n.sidecar.MachineID), channel, 3)
 }
 
+//SubscribeGroup 以消费组订阅频道，Publish时每个消费组只有一个节点收到（组内轮询），不同组各收到一份；
+//Notify、Call等仍在所有订阅者中选择。group为空时同Subscribe。
+func (n *Node) SubscribeGroup(channel uint16, group string, f func(*ContextMQ)) {
+	pw := processWrapper{
+		n: n,
+		f: f,
+	}
+	if err := n.handleChannel(channel, n, pw.processWrapper); err != nil {
+		n.Logger.Error("SubscribeGroup|", err.Error(), channel)
+		return
+	}
+	n.sidecar.SetGroupChannel(uint16(n.sidecar.MachineID), channel, group)
+}
+
+//ErrChannelClaimed 同一节点上一个频道只能由一个Serial或处理函数订阅
+var ErrChannelClaimed = errors.New("domi.Subscribe|频道已被本节点的其它Serial或处理函数订阅。")
+
+//handleChannel 登记频道的处理者后设置处理函数，频道已被其它处理者订阅时返回ErrChannelClaimed。
+func (n *Node) handleChannel(channel uint16, owner interface{}, f func(transport.Session) error) error {
+	if err := n.claimChannel(channel, owner); err != nil {
+		return err
+	}
+	n.sidecar.HandleFunc(channel, f)
+	return nil
+}
+
+//claimChannel 登记频道的处理者，owner为*Node时表示节点上的处理函数，为*streamTable时表示流。
+func (n *Node) claimChannel(channel uint16, owner interface{}) error {
+	n.ownerMutex.Lock()
+	defer n.ownerMutex.Unlock()
+	if o, ok := n.owners[channel]; ok && o != owner {
+		return ErrChannelClaimed
+	}
+	n.owners[channel] = owner
+	return nil
+}
+
+//releaseChannel 注销频道的处理者，频道属于其它处理者时返回false。
+func (n *Node) releaseChannel(channel uint16, owner interface{}) bool {
+	n.ownerMutex.Lock()
+	defer n.ownerMutex.Unlock()
+	if o, ok := n.owners[channel]; ok && o != owner {
+		return false
+	}
+	delete(n.owners, channel)
+	return true
+}
+
 //
 func (pw processWrapper) processWrapper(s transport.Session) error {
+	pw.process(s.GetFrameSlice())
+	return nil
+}
+
+//process 调用处理函数，拦截异常。
+func (pw processWrapper) process(fs transport.FrameSlice) {
 	defer func() {
 		if r := recover(); r != nil {
-			pw.n.Logger.Error("processWrapper|异常频道：", s.GetFrameSlice().GetFrameType())
+			pw.n.Logger.Error("processWrapper|异常频道：", fs.GetFrameType())
 			pw.n.Logger.Error("processWrapper|异常拦截：", r, string(debug.Stack()))
+			if dead, ok := pw.n.deadLetters.get(fs.GetFrameType()); ok {
+				pw.n.sendDeadLetter(dead, fs.GetFrameType(), fs.GetData(), fs.GetExtend(), fmt.Sprint("panic: ", r))
+			}
+			//pipeline的阶段异常时通知发起节点
+			if v := getPipeline(fs.GetExtend()); v != nil {
+				pw.n.pipelineFail(v, []byte(fmt.Sprint("panic: ", r)), func(err error) {
+					pw.n.Logger.Error("processWrapper|", err.Error())
+				})
+			}
 		}
 	}()
 	c := &ContextMQ{
-		Request: s.GetFrameSlice().GetData(),
-		ex:      s.GetFrameSlice().GetExtend(),
+		Request: fs.GetData(),
+		ex:      fs.GetExtend(),
+	}
+	//已确认的重复投递，再次确认后丢弃。
+	if v := getExtend(c.ex, extendAck); len(v) == 11 && pw.n.duplicate(v) {
+		pw.n.sendAck(v, func(err error) { pw.n.Logger.Error("processWrapper|", err.Error()) })
+		return
 	}
 	//修改slice 的cap
 	r := (*[3]uintptr)(unsafe.Pointer(&c.Request))
 	r[2] = r[1]
 	c.Node = pw.n
 	pw.f(c)
-	return nil
 }
 
-//Unsubscribe 退订频道
+//Unsubscribe 退订频道，频道由本节点的Serial订阅时忽略。
 func (n *Node) Unsubscribe(channel uint16) {
+	n.unsubscribe(channel, n)
+}
+
+//unsubscribe 处理者退订频道，不退订其它处理者的频道。
+func (n *Node) unsubscribe(channel uint16, owner interface{}) {
+	if !n.releaseChannel(channel, owner) {
+		n.Logger.Error("Unsubscribe|", ErrChannelClaimed.Error(), channel)
+		return
+	}
 	n.sidecar.SetChannel(uint16(n.sidecar.MachineID), channel, 4)
 	//n.sidecar.HandleFunc(channel, nil)
 }
 
+//SetBalancer 设置频道的负载均衡策略，作用于Notify、Call、Request，nil时为轮询。
+func (n *Node) SetBalancer(channel uint16, b sidecar.Balancer) {
+	n.sidecar.SetBalancer(channel, b)
+}
+
 //Notify 不回复请求，申请一服务处理。
 func (n *Node) Notify(channel uint16, data []byte, reject func(error)) {
 	fs := transport.NewFrameSlice(channel, data, nil)
-	n.sidecar.AskOne(channel, fs, reject)
+	n.sidecar.AskOne(channel, fs, n.deadLetterReject(channel, fs, reject))
 }
 
 //Call 请求	request-reply模式, 1 Vs 1
 func (n *Node) Call(channel uint16, data []byte, resolve uint16, reject func(error)) {
-	ex := make([]byte, 4)
-	util.CopyUint16(ex[:2], uint16(n.sidecar.MachineID))
-	util.CopyUint16(ex[2:4], resolve)
+	v := make([]byte, 4)
+	util.CopyUint16(v[:2], uint16(n.sidecar.MachineID))
+	util.CopyUint16(v[2:4], resolve)
+	fs := transport.NewFrameSlice(channel, data, appendExtend(nil, extendReply, v))
+	n.sidecar.AskOne(channel, fs, n.deadLetterReject(channel, fs, reject))
+}
+
+//ErrKeyTooLong 定义错误
+var ErrKeyTooLong = errors.New("domi.NotifyKey|路由键长度超过255。")
+
+//NotifyKey 不回复请求，按路由键以一致性哈希选择服务处理，相同的键发往同一节点。
+func (n *Node) NotifyKey(channel uint16, key string, data []byte, reject func(error)) {
+	if len(key) > 255 {
+		reject(ErrKeyTooLong)
+		return
+	}
+	fs := transport.NewFrameSlice(channel, data, appendExtend(nil, extendKey, []byte(key)))
+	n.sidecar.AskKey(channel, []byte(key), fs, n.deadLetterReject(channel, fs, reject))
+}
+
+//CallKey 请求	request-reply模式, 1 Vs 1，按路由键以一致性哈希选择服务处理，相同的键发往同一节点。
+func (n *Node) CallKey(channel uint16, key string, data []byte, resolve uint16, reject func(error)) {
+	if len(key) > 255 {
+		reject(ErrKeyTooLong)
+		return
+	}
+	v := make([]byte, 4)
+	util.CopyUint16(v[:2], uint16(n.sidecar.MachineID))
+	util.CopyUint16(v[2:4], resolve)
+	ex := appendExtend(nil, extendReply, v)
+	ex = appendExtend(ex, extendKey, []byte(key))
 	fs := transport.NewFrameSlice(channel, data, ex)
-	n.sidecar.AskOne(channel, fs, reject)
+	n.sidecar.AskKey(channel, []byte(key), fs, n.deadLetterReject(channel, fs, reject))
 }
 
 //Publish 发布，通知所有订阅频道的节点,1 Vs N
 //只有一个节点发表时为publisher-subscriber模式，所有节点都能发表为bus模式
 func (n *Node) Publish(channel uint16, data []byte, reject func(error)) {
 	fs := transport.NewFrameSlice(channel, data, nil)
-	n.sidecar.AskAll(channel, fs, reject)
+	n.sidecar.AskAll(channel, fs, n.deadLetterReject(channel, fs, reject))
 }
 
 //ContextMQ 上下文
@@ -155,50 +313,37 @@ type ContextMQ struct {
 	ex      []byte
 }
 
-//Reply 回复 request-reply模式 。
-func (c *ContextMQ) Reply(data []byte, reject func(error)) {
-	if c.ex == nil {
-		reject(errors.New("Reply|需ex。"))
-		return
-	}
-	if len(c.ex) != 4 {
-		reject(errors.New("Reply|ex长度不为4。"))
-		return
-	}
-	id := util.BytesToUint16(c.ex[:2])
-	channel := util.BytesToUint16(c.ex[2:4])
-	fs := transport.NewFrameSlice(channel, data, nil)
-	c.sidecar.Specify(id, channel, fs, reject)
+//Key 路由键，NotifyKey、CallKey以外发送的请求为空。
+func (c *ContextMQ) Key() string {
+	return string(getExtend(c.ex, extendKey))
 }
 
-/*
-//Ventilator 开始 pipeline模式，数据在不同服务之间传递，后续服务需调用Next，最后一个服务不可调用Next。
-func (n *Node) Ventilator(channel []uint16, data []byte, reject func(error)) {
-	if len(channel) < 2 {
-		reject(errors.New("Ventilator|频道数量小于2"))
+//Reply 回复 request-reply模式，回复Call或Request。
+func (c *ContextMQ) Reply(data []byte, reject func(error)) {
+	if v := getExtend(c.ex, extendRequest); len(v) == 10 {
+		id := util.BytesToUint16(v[:2])
+		rv := make([]byte, 10)
+		util.CopyUint16(rv[:2], uint16(c.sidecar.MachineID))
+		copy(rv[2:], v[2:])
+		fs := transport.NewFrameSlice(transport.FrameTypeReply, data, appendExtend(nil, extendRequest, rv))
+		c.sidecar.Specify(id, transport.FrameTypeReply, fs, reject)
 		return
 	}
-	l := len(channel)
-	vj := make([]byte, 2*l)
-	for i := 1; i < l; i++ {
-		util.CopyUint16(vj[2*i:2*i+2], channel[i])
+	v := getExtend(c.ex, extendReply)
+	//兼容旧版本的Call：ex为4字节的回复地址
+	if len(c.ex) == 4 && !validExtend(c.ex) {
+		v = c.ex
 	}
-	fs := transport.NewFrameSlice(channel[0], data, vj[2:])
-	n.sidecar.AskOne(channel[0], fs, reject)
-}
-
-//Next 下一个 pipeline模式 发布使用Ventilator，后续服务用Next，最后一个服务不得使用Next
-func (c *ContextMQ) Next(data []byte, reject func(error)) {
-	if c.ex == nil {
-		reject(errors.New("Next|需ex。"))
+	if v == nil {
+		reject(errors.New("Reply|ex未包含回复地址。"))
 		return
 	}
-	if len(c.ex) < 2 {
-		reject(errors.New("Next|最后一个服务不得使用Next。"))
+	if len(v) != 4 {
+		reject(errors.New("Reply|回复地址长度不为4。"))
 		return
 	}
-	channel := util.BytesToUint16(c.ex[:2])
-	fs := transport.NewFrameSlice(channel, data, c.ex[2:])
-	c.sidecar.AskOne(channel, fs, reject)
+	id := util.BytesToUint16(v[:2])
+	channel := util.BytesToUint16(v[2:4])
+	fs := transport.NewFrameSlice(channel, data, nil)
+	c.sidecar.Specify(id, channel, fs, reject)
 }
-*/
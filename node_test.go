@@ -4,14 +4,22 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/duomi520/domi/sidecar"
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
 )
 
-var testEndpoints = []string{"localhost:2379"}
+//使用进程内的注册中心，无需启动etcd。
+var testRegistry = sidecar.NewMemoryRegistry()
 
 var testNodeTableMutex sync.Mutex
 var testNodeTable []string
@@ -62,21 +70,21 @@ func test2Node(port int) (context.CancelFunc, *Node, *Node) {
 	p2 := strconv.Itoa(port + 1)
 	ctx, ctxExitFunc := context.WithCancel(context.Background())
 	n1 := &Node{
-		Ctx:       ctx,
-		Name:      "1/server/",
-		HTTPPort:  ":7" + p1,
-		TCPPort:   ":9" + p1,
-		Endpoints: testEndpoints,
+		Ctx:         ctx,
+		Name:        "1/server/",
+		HTTPPort:    ":7" + p1,
+		TCPPort:     ":9" + p1,
+		Distributer: testRegistry.NewDistributer(),
 	}
 	n1.Init()
 	go n1.Run()
 	n1.WaitInit()
 	n2 := &Node{
-		Ctx:       ctx,
-		Name:      "2/server/",
-		HTTPPort:  ":7" + p2,
-		TCPPort:   ":9" + p2,
-		Endpoints: testEndpoints,
+		Ctx:         ctx,
+		Name:        "2/server/",
+		HTTPPort:    ":7" + p2,
+		TCPPort:     ":9" + p2,
+		Distributer: testRegistry.NewDistributer(),
 	}
 	n2.Init()
 	go n2.Run()
@@ -91,41 +99,41 @@ func test4Node(port int) (context.CancelFunc, *Node, *Node, *Node, *Node) {
 	p4 := strconv.Itoa(port + 3)
 	ctx, ctxExitFunc := context.WithCancel(context.Background())
 	n1 := &Node{
-		Ctx:       ctx,
-		Name:      "1/server/",
-		HTTPPort:  ":7" + p1,
-		TCPPort:   ":9" + p1,
-		Endpoints: testEndpoints,
+		Ctx:         ctx,
+		Name:        "1/server/",
+		HTTPPort:    ":7" + p1,
+		TCPPort:     ":9" + p1,
+		Distributer: testRegistry.NewDistributer(),
 	}
 	n1.Init()
 	go n1.Run()
 	n1.WaitInit()
 	n2 := &Node{
-		Ctx:       ctx,
-		Name:      "2/server/",
-		HTTPPort:  ":7" + p2,
-		TCPPort:   ":9" + p2,
-		Endpoints: testEndpoints,
+		Ctx:         ctx,
+		Name:        "2/server/",
+		HTTPPort:    ":7" + p2,
+		TCPPort:     ":9" + p2,
+		Distributer: testRegistry.NewDistributer(),
 	}
 	n2.Init()
 	go n2.Run()
 	n2.WaitInit()
 	n3 := &Node{
-		Ctx:       ctx,
-		Name:      "3/server/",
-		HTTPPort:  ":7" + p3,
-		TCPPort:   ":9" + p3,
-		Endpoints: testEndpoints,
+		Ctx:         ctx,
+		Name:        "3/server/",
+		HTTPPort:    ":7" + p3,
+		TCPPort:     ":9" + p3,
+		Distributer: testRegistry.NewDistributer(),
 	}
 	n3.Init()
 	go n3.Run()
 	n3.WaitInit()
 	n4 := &Node{
-		Ctx:       ctx,
-		Name:      "4/server/",
-		HTTPPort:  ":7" + p4,
-		TCPPort:   ":9" + p4,
-		Endpoints: testEndpoints,
+		Ctx:         ctx,
+		Name:        "4/server/",
+		HTTPPort:    ":7" + p4,
+		TCPPort:     ":9" + p4,
+		Distributer: testRegistry.NewDistributer(),
 	}
 	n4.Init()
 	go n4.Run()
@@ -165,6 +173,778 @@ func Test_ReqRep2(t *testing.T) {
 	})
 }
 
+//旧版本的Call，ex为4字节的回复地址
+func Test_ReplyLegacy(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(650)
+	n2.Subscribe(56, testRequest)
+	n1.Subscribe(57, testReply)
+	time.Sleep(500 * time.Millisecond)
+	ex := make([]byte, 4)
+	util.CopyUint16(ex[:2], uint16(n1.sidecar.MachineID))
+	util.CopyUint16(ex[2:4], 57)
+	n1.sidecar.AskOne(56, transport.NewFrameSlice(56, []byte("Hellow"), ex), testError)
+	time.Sleep(50 * time.Millisecond)
+	ctxExitFunc()
+	time.Sleep(50 * time.Millisecond)
+	testTableVerification(t, []string{
+		"1 testRequest:Hellow",
+		"0 testReply:Hi",
+	})
+}
+
+func Test_Request1(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(180)
+	n2.Subscribe(58, testRequest)
+	n2.Subscribe(59, func(ctx *ContextMQ) {})
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		reply, err := n1.Request(context.TODO(), 58, []byte("Hellow"+strconv.Itoa(i)))
+		if err != nil || string(reply) != "Hi" {
+			t.Fatal(string(reply), err)
+		}
+	}
+	//无回复时超时
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	f := n1.RequestAsync(ctx, 59, []byte("Timeout"))
+	if _, err := f.Get(); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	n1.requests.mutex.Lock()
+	l := len(n1.requests.pending)
+	n1.requests.mutex.Unlock()
+	if l != 0 {
+		t.Fatal("未清理等待的请求:", l)
+	}
+	ctxExitFunc()
+	time.Sleep(50 * time.Millisecond)
+	testNodeTable = nil
+}
+
+//testDistributer 在sidecar包外实现Distributer，转发到进程内的注册中心。
+type testDistributer struct {
+	d sidecar.Distributer
+}
+
+func (t *testDistributer) RegisterServer(info sidecar.Info, operation interface{}) (int64, int, error) {
+	return t.d.RegisterServer(info, operation)
+}
+func (t *testDistributer) GetInitAddress() []sidecar.Info { return t.d.GetInitAddress() }
+func (t *testDistributer) DisconDistributer() error       { return t.d.DisconDistributer() }
+func (t *testDistributer) PutKey(ctx context.Context, key, value string) error {
+	return t.d.PutKey(ctx, key, value)
+}
+func (t *testDistributer) DeleteKey(ctx context.Context, key string) error {
+	return t.d.DeleteKey(ctx, key)
+}
+func (t *testDistributer) GetKey(ctx context.Context, key string) ([][]byte, error) {
+	return t.d.GetKey(ctx, key)
+}
+func (t *testDistributer) Events() <-chan sidecar.Event { return t.d.Events() }
+
+func Test_customDistributer(t *testing.T) {
+	ctx, ctxExitFunc := context.WithCancel(context.Background())
+	n1 := &Node{
+		Ctx:         ctx,
+		Name:        "1/server/",
+		HTTPPort:    ":7320",
+		TCPPort:     ":9320",
+		Distributer: &testDistributer{d: testRegistry.NewDistributer()},
+	}
+	n1.Init()
+	go n1.Run()
+	n1.WaitInit()
+	n2 := &Node{
+		Ctx:         ctx,
+		Name:        "2/server/",
+		HTTPPort:    ":7321",
+		TCPPort:     ":9321",
+		Distributer: testRegistry.NewDistributer(),
+	}
+	n2.Init()
+	go n2.Run()
+	n2.WaitInit()
+	n2.Subscribe(58, testRequest)
+	time.Sleep(500 * time.Millisecond)
+	reply, err := n1.Request(context.TODO(), 58, []byte("Hellow"))
+	if err != nil || string(reply) != "Hi" {
+		t.Fatal(string(reply), err)
+	}
+	ctxExitFunc()
+	time.Sleep(50 * time.Millisecond)
+	testNodeTable = nil
+}
+
+func Test_Balancer(t *testing.T) {
+	ctxExitFunc, n1, n2, n3, _ := test4Node(190)
+	n2.Subscribe(62, testReply)
+	n3.Subscribe(62, testReply)
+	time.Sleep(500 * time.Millisecond)
+	n1.SetBalancer(62, sidecar.NewWeightedRoundRobinBalancer(map[uint16]int{uint16(n2.sidecar.MachineID): 3}))
+	for i := 0; i < 8; i++ {
+		n1.Notify(62, []byte("wrr"), testError)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ctxExitFunc()
+	time.Sleep(50 * time.Millisecond)
+	testTableVerificationDisorder(t, []string{
+		"1 testReply:wrr", "1 testReply:wrr", "1 testReply:wrr", "1 testReply:wrr",
+		"1 testReply:wrr", "1 testReply:wrr", "2 testReply:wrr", "2 testReply:wrr",
+	})
+}
+
+func Test_NotifyKey(t *testing.T) {
+	ctxExitFunc, n1, n2, n3, n4 := test4Node(200)
+	n2.Subscribe(63, testKey)
+	n3.Subscribe(63, testKey)
+	n4.Subscribe(63, testKey)
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 30; i++ {
+		n1.NotifyKey(63, "room"+strconv.Itoa(i%3), nil, testError)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ctxExitFunc()
+	time.Sleep(50 * time.Millisecond)
+	defer func() { testNodeTable = nil }()
+	if len(testNodeTable) != 30 {
+		t.Fatal(testNodeTable)
+	}
+	owner := make(map[string]string)
+	for _, v := range testNodeTable {
+		s := strings.Split(v, " ")
+		if o, ok := owner[s[1]]; ok && o != s[0] {
+			t.Fatal("相同的键发往不同节点:", testNodeTable)
+		}
+		owner[s[1]] = s[0]
+	}
+}
+
+func Test_Gather(t *testing.T) {
+	ctxExitFunc, n1, n2, n3, n4 := test4Node(220)
+	echo := func(ctx *ContextMQ) {
+		ctx.Reply([]byte(strconv.Itoa(ctx.sidecar.MachineID)), testError)
+	}
+	n2.Subscribe(64, echo)
+	n3.Subscribe(64, echo)
+	n4.Subscribe(64, func(ctx *ContextMQ) {})
+	n2.Subscribe(65, echo)
+	n3.Subscribe(65, echo)
+	n4.Subscribe(65, echo)
+	time.Sleep(500 * time.Millisecond)
+	defer ctxExitFunc()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	replies, err := n1.Gather(ctx, 65, []byte("who"))
+	if err != nil || len(replies) != 3 {
+		t.Fatal(replies, err)
+	}
+	for _, r := range replies {
+		if string(r.Data) != strconv.Itoa(int(r.From)) {
+			t.Fatal(r)
+		}
+	}
+	if replies, err = n1.Gather(ctx, 65, []byte("who"), GatherFirst(1)); err != nil || len(replies) != 1 {
+		t.Fatal(replies, err)
+	}
+	if replies, err = n1.Gather(ctx, 64, []byte("who"), GatherMajority()); err != nil || len(replies) != 2 {
+		t.Fatal(replies, err)
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	if replies, err = n1.Gather(short, 64, []byte("who")); err != context.DeadlineExceeded || len(replies) != 2 {
+		t.Fatal(replies, err)
+	}
+	if _, err = n1.Gather(ctx, 66, []byte("who")); err != ErrGatherNone {
+		t.Fatal(err)
+	}
+}
+
+func Test_gatherCall(t *testing.T) {
+	newCall := func(quorum GatherOption) *gatherCall {
+		return &gatherCall{sent: -1, lost: make(map[int]bool), quorum: quorum, done: make(chan struct{})}
+	}
+	isDone := func(g *gatherCall) bool {
+		select {
+		case <-g.done:
+			return true
+		default:
+			return false
+		}
+	}
+	//同一目标失败两次只计一次，法定数量按发送数计算。
+	g := newCall(GatherMajority())
+	g.failed(0)(ErrRequestClosed)
+	g.setSent(5)
+	g.failed(0)(ErrRequestClosed)
+	g.add(Reply{From: 2})
+	g.add(Reply{From: 3})
+	if isDone(g) || len(g.lost) != 1 {
+		t.Fatal(g.replies, g.lost)
+	}
+	g.add(Reply{From: 4})
+	if !isDone(g) || g.err != nil {
+		t.Fatal(g.replies, g.err)
+	}
+	//失败过多无法达到法定数量
+	g = newCall(GatherMajority())
+	g.setSent(3)
+	g.add(Reply{From: 2})
+	g.failed(1)(ErrRequestClosed)
+	if isDone(g) {
+		t.Fatal(g.replies, g.lost)
+	}
+	g.failed(2)(ErrRequestClosed)
+	if !isDone(g) || g.err != ErrGatherQuorum || len(g.result()) != 1 {
+		t.Fatal(g.replies, g.err)
+	}
+}
+
+func Test_Reliable(t *testing.T) {
+	ctxExitFunc, n1, n2, n3, n4 := test4Node(230)
+	n1.reliable = newReliableTable(ReliableConfigure{AckTimeout: 200 * time.Millisecond, MaxAttempts: 3})
+	record := func(ctx *ContextMQ, text string) {
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, fmt.Sprintf("%s %s %v", text, ctx.Request, ctx.Redelivered()))
+		testNodeTableMutex.Unlock()
+	}
+	//n2 收到后不确认，模拟处理前崩溃。
+	n2.Subscribe(67, func(ctx *ContextMQ) { record(ctx, "lost") })
+	n3.Subscribe(67, func(ctx *ContextMQ) {
+		record(ctx, "acked")
+		ctx.Ack(testError)
+	})
+	n4.Subscribe(68, func(ctx *ContextMQ) { record(ctx, "lost") })
+	time.Sleep(500 * time.Millisecond)
+	defer ctxExitFunc()
+	var rejected error
+	var mutex sync.Mutex
+	n1.NotifyReliable(67, []byte("m1"), func(err error) { t.Error(err) })
+	n1.NotifyReliable(68, []byte("m2"), func(err error) {
+		mutex.Lock()
+		rejected = err
+		mutex.Unlock()
+	})
+	time.Sleep(1200 * time.Millisecond)
+	mutex.Lock()
+	if rejected != ErrNotAcked {
+		t.Error("未返回ErrNotAcked:", rejected)
+	}
+	mutex.Unlock()
+	testNodeTableMutex.Lock()
+	acked, lost := 0, 0
+	for _, v := range testNodeTable {
+		switch v {
+		case "acked m1 false", "acked m1 true":
+			acked++
+		case "lost m1 false", "lost m2 false", "lost m2 true":
+			lost++
+		default:
+			t.Error(v)
+		}
+	}
+	testNodeTable = nil
+	testNodeTableMutex.Unlock()
+	if acked != 1 || lost < 3 || lost > 4 {
+		t.Fatal("投递次数异常:", acked, lost)
+	}
+	n1.reliable.mutex.Lock()
+	defer n1.reliable.mutex.Unlock()
+	if len(n1.reliable.pending) != 0 {
+		t.Fatal("未清除:", n1.reliable.pending)
+	}
+}
+
+func Test_dedup(t *testing.T) {
+	n := &Node{reliable: newReliableTable(ReliableConfigure{DedupWindow: time.Minute})}
+	v := make([]byte, 11)
+	util.CopyInt64(v[2:10], 7)
+	v[10] = 1
+	if n.duplicate(v) {
+		t.Fatal("未确认的消息")
+	}
+	n.reliable.acked[dedupKey{from: 0, id: 7}] = time.Now()
+	if !n.duplicate(v) {
+		t.Fatal("已确认的消息")
+	}
+	n.reliable.acked[dedupKey{from: 0, id: 7}] = time.Now().Add(-2 * time.Minute)
+	if n.duplicate(v) {
+		t.Fatal("超出去重窗口")
+	}
+}
+
+func Test_Durable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctxExitFunc, n1, n2 := test2Node(240)
+	defer ctxExitFunc()
+	wc := util.WALConfigure{Dir: dir, SyncPolicy: util.SyncInterval}
+	d, err := n2.SubscribeDurable(69, "c1", wc, testReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		n1.Notify(69, []byte(strconv.Itoa(i)), testError)
+	}
+	n1.NotifyReliable(69, []byte("3"), testError)
+	time.Sleep(100 * time.Millisecond)
+	d.Close()
+	if offset, err := d.Committed(); err != nil || offset != 4 {
+		t.Fatal(offset, err)
+	}
+	n1.reliable.mutex.Lock()
+	if len(n1.reliable.pending) != 0 {
+		t.Error("未确认:", n1.reliable.pending)
+	}
+	n1.reliable.mutex.Unlock()
+	//重启后从最后提交的偏移量继续
+	d, err = n2.SubscribeDurable(69, "c1", wc, testReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	d.Close()
+	d, err = n2.SubscribeDurable(69, "c2", wc, testReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	d.Close()
+	id := strconv.Itoa(n2.sidecar.MachineID)
+	testTableVerification(t, []string{
+		id + " testReply:0", id + " testReply:1", id + " testReply:2", id + " testReply:3",
+		id + " testReply:0", id + " testReply:1", id + " testReply:2", id + " testReply:3",
+	})
+}
+
+func Test_DurableAppendFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctxExitFunc, n1, n2 := test2Node(660)
+	var letters []string
+	var mutex sync.Mutex
+	n1.Subscribe(76, func(ctx *ContextMQ) {
+		_, _, reason, _ := ctx.DeadLetter()
+		mutex.Lock()
+		letters = append(letters, string(ctx.Request)+" "+reason)
+		mutex.Unlock()
+	})
+	n2.SetDeadLetter(77, 76)
+	d, err := n2.SubscribeDurable(77, "c1", util.WALConfigure{Dir: dir}, testReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2.Subscribe(78, testReply)
+	time.Sleep(500 * time.Millisecond)
+	//日志写入失败时不断开连接
+	d.wal.Close()
+	n1.Notify(77, []byte("a"), testError)
+	n1.NotifyReliable(77, []byte("b"), func(error) {})
+	n1.Notify(78, []byte("c"), testError)
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	if len(letters) != 1 || letters[0] != "a "+util.ErrWALClosed.Error() {
+		t.Error(letters)
+	}
+	mutex.Unlock()
+	n1.reliable.mutex.Lock()
+	if len(n1.reliable.pending) != 1 {
+		t.Error("可靠投递的消息不应确认:", n1.reliable.pending)
+	}
+	n1.reliable.mutex.Unlock()
+	//节点退出时不退订
+	ctxExitFunc()
+	d.Close()
+	n2.ownerMutex.Lock()
+	owner := n2.owners[77]
+	n2.ownerMutex.Unlock()
+	if owner != n2 {
+		t.Error("节点退出时不应退订:", owner)
+	}
+	testTableVerification(t, []string{strconv.Itoa(n2.sidecar.MachineID) + " testReply:c"})
+}
+
+func Test_DeadLetter(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(250)
+	defer ctxExitFunc()
+	var letters []*ContextMQ
+	var mutex sync.Mutex
+	n1.Subscribe(90, func(ctx *ContextMQ) {
+		c := &ContextMQ{Node: ctx.Node, Request: append([]byte(nil), ctx.Request...), ex: append([]byte(nil), ctx.ex...)}
+		mutex.Lock()
+		letters = append(letters, c)
+		mutex.Unlock()
+	})
+	n1.SetNodeDeadLetter(90)
+	n2.SetDeadLetter(92, 90)
+	n2.Subscribe(92, func(ctx *ContextMQ) {
+		panic(string(ctx.Request))
+	})
+	time.Sleep(500 * time.Millisecond)
+	n1.Notify(91, []byte("lost"), func(error) {})
+	n1.Notify(92, []byte("boom"), testError)
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	if len(letters) != 2 {
+		t.Fatal(len(letters))
+	}
+	reasons := make(map[string]*ContextMQ)
+	for _, c := range letters {
+		channel, from, reason, ok := c.DeadLetter()
+		if !ok {
+			t.Fatal("不是死信")
+		}
+		switch channel {
+		case 91:
+			if from != uint16(n1.sidecar.MachineID) || string(c.Request) != "lost" || !strings.Contains(reason, "91") {
+				t.Fatal(from, string(c.Request), reason)
+			}
+		case 92:
+			if from != uint16(n2.sidecar.MachineID) || reason != "panic: boom" {
+				t.Fatal(from, reason)
+			}
+		}
+		reasons[strconv.Itoa(int(channel))] = c
+	}
+	mutex.Unlock()
+	//重放
+	n2.Subscribe(91, testReply)
+	time.Sleep(100 * time.Millisecond)
+	reasons["91"].Replay(testError)
+	(&ContextMQ{Node: n1}).Replay(func(err error) {
+		if err != ErrNotDeadLetter {
+			t.Error(err)
+		}
+	})
+	time.Sleep(100 * time.Millisecond)
+	testTableVerification(t, []string{strconv.Itoa(n2.sidecar.MachineID) + " testReply:lost"})
+}
+
+func Test_NotifyAt(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(260)
+	defer ctxExitFunc()
+	n2.Subscribe(93, testReply)
+	time.Sleep(500 * time.Millisecond)
+	n1.NotifyAfter(93, []byte("b"), 100*time.Millisecond, testError)
+	n1.NotifyAt(93, []byte("a"), time.Now().Add(50*time.Millisecond), testError)
+	id := n1.NotifyAfter(93, []byte("c"), 50*time.Millisecond, testError)
+	if !n1.CancelNotify(id) || n1.CancelNotify(id) {
+		t.Fatal("取消失败")
+	}
+	time.Sleep(300 * time.Millisecond)
+	m := strconv.Itoa(n2.sidecar.MachineID)
+	testTableVerification(t, []string{m + " testReply:a", m + " testReply:b"})
+}
+
+func Test_scheduleWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wc := &util.WALConfigure{Dir: dir, SegmentSize: 4096, SyncPolicy: util.SyncNever}
+	logger, _ := util.NewLogger(util.ErrorLevel, "")
+	open := func() *Node {
+		n := &Node{Logger: logger, scheduler: newScheduler(ScheduleConfigure{WAL: wc})}
+		if err := n.openSchedule(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	//按大小、时间保留会删除未到期的消息
+	retention := *wc
+	retention.RetentionAge = time.Minute
+	if err := (&Node{Logger: logger, scheduler: newScheduler(ScheduleConfigure{WAL: &retention})}).openSchedule(); err != ErrScheduleRetention {
+		t.Fatal(err)
+	}
+	n := open()
+	keep := n.NotifyAfter(93, []byte("keep"), time.Hour, testError)
+	for i := 0; i < scheduleCompactRecords; i++ {
+		n.CancelNotify(n.NotifyAfter(93, nil, time.Hour, testError))
+	}
+	n.scheduler.mutex.Lock()
+	n.compactSchedule()
+	n.scheduler.mutex.Unlock()
+	if first, next := n.scheduler.wal.Offsets(); next-first > 200 {
+		t.Fatal("未压缩:", first, next)
+	}
+	n.closeSchedule()
+	//重启后恢复
+	n = open()
+	defer n.closeSchedule()
+	m, ok := n.scheduler.pending[keep]
+	if len(n.scheduler.pending) != 1 || !ok || string(m.data) != "keep" || m.channel != 93 {
+		t.Fatal(n.scheduler.pending)
+	}
+	if id := n.NotifyAfter(93, nil, time.Hour, testError); id <= keep {
+		t.Fatal(id, keep)
+	}
+}
+
+func Test_Topic(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(280)
+	defer ctxExitFunc()
+	topicReply := func(ctx *ContextMQ) {
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, strconv.Itoa(ctx.sidecar.MachineID)+" "+ctx.Topic()+":"+string(ctx.Request))
+		testNodeTableMutex.Unlock()
+	}
+	if err := n1.SubscribeTopic("chat.room.*.msg", topicReply); err != nil {
+		t.Fatal(err)
+	}
+	n2.SubscribeTopic("chat.>", topicReply)
+	n2.SubscribeTopic("chat.room.42.msg", topicReply)
+	if err := n2.SubscribeTopic("chat.>.msg", topicReply); err != sidecar.ErrTopicInvalid {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	n1.PublishTopic("chat.room.42.msg", []byte("a"), testError)
+	n1.PublishTopic("chat.lobby", []byte("b"), testError)
+	n1.PublishTopic("chat.*", []byte("c"), func(err error) {
+		if err != sidecar.ErrTopicInvalid {
+			t.Error(err)
+		}
+	})
+	time.Sleep(100 * time.Millisecond)
+	m1, m2 := strconv.Itoa(n1.sidecar.MachineID), strconv.Itoa(n2.sidecar.MachineID)
+	testTableVerificationDisorder(t, []string{
+		m1 + " chat.room.42.msg:a", m2 + " chat.room.42.msg:a", m2 + " chat.room.42.msg:a", m2 + " chat.lobby:b",
+	})
+	n2.UnsubscribeTopic("chat.>")
+	n2.UnsubscribeTopic("chat.room.42.msg")
+	time.Sleep(100 * time.Millisecond)
+	n2.NotifyTopic("chat.room.7.msg", []byte("d"), testError)
+	n2.NotifyTopic("chat.lobby", []byte("e"), func(error) {
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, "lost")
+		testNodeTableMutex.Unlock()
+	})
+	time.Sleep(100 * time.Millisecond)
+	testTableVerification(t, []string{"lost", m1 + " chat.room.7.msg:d"})
+}
+
+func Test_Ordered(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(290)
+	defer ctxExitFunc()
+	var mutex sync.Mutex
+	seen := make(map[string][]int)
+	n2.SubscribeOrdered(94, 4, func(ctx *ContextMQ) {
+		v, _ := strconv.Atoi(string(ctx.Request))
+		//处理时间不同，不影响同一键的顺序。
+		time.Sleep(time.Duration(v%3) * time.Millisecond)
+		mutex.Lock()
+		seen[ctx.Key()] = append(seen[ctx.Key()], v)
+		mutex.Unlock()
+	})
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 200; i++ {
+		n1.NotifyKey(94, "k"+strconv.Itoa(i%5), []byte(strconv.Itoa(i)), testError)
+	}
+	time.Sleep(500 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(seen) != 5 {
+		t.Fatal(seen)
+	}
+	for key, s := range seen {
+		if len(s) != 40 {
+			t.Fatal(key, s)
+		}
+		for i := 1; i < len(s); i++ {
+			if s[i] <= s[i-1] {
+				t.Fatal(key, s)
+			}
+		}
+	}
+}
+
+func Test_Stream(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(300)
+	defer ctxExitFunc()
+	//回显，读完后返回，自动半关闭。
+	n2.HandleStream(95, func(st *Stream) {
+		for {
+			data, err := st.Recv()
+			if err != nil {
+				if err != io.EOF {
+					t.Error(err)
+				}
+				return
+			}
+			if err := st.Send(data); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+	n2.Subscribe(96, testReply)
+	reset := make(chan error, 1)
+	n2.HandleStream(97, func(st *Stream) {
+		_, err := st.Recv()
+		reset <- err
+	})
+	//流频道不可再订阅
+	n2.Subscribe(95, testReply)
+	n2.ownerMutex.Lock()
+	owner := n2.owners[95]
+	n2.ownerMutex.Unlock()
+	if owner != n2.streams {
+		t.Fatal("流频道被订阅。")
+	}
+	time.Sleep(500 * time.Millisecond)
+	//普通消息被丢弃，不影响会话
+	n1.Notify(95, []byte("Hellow"), testError)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	st, err := n1.OpenStream(ctx, 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Peer() != uint16(n2.sidecar.MachineID) {
+		t.Fatal(st.Peer())
+	}
+	//超过单帧大小及接收窗口
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	received := make([]byte, 0, len(data))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			v, err := st.Recv()
+			if err != nil {
+				if err != io.EOF {
+					t.Error(err)
+				}
+				return
+			}
+			received = append(received, v...)
+		}
+	}()
+	if err := st.Send(data); err != nil {
+		t.Fatal(err)
+	}
+	st.CloseSend()
+	if err := st.Send(data); err != ErrStreamClosed {
+		t.Fatal(err)
+	}
+	<-done
+	if !bytes.Equal(received, data) {
+		t.Fatal(len(received))
+	}
+	if _, err := n1.OpenStream(ctx, 96); err != ErrStreamNoHandle {
+		t.Fatal(err)
+	}
+	st, err = n1.OpenStream(ctx, 97)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if err := <-reset; err != ErrStreamReset {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	n1.streams.mutex.Lock()
+	n2.streams.mutex.Lock()
+	if len(n1.streams.streams) != 0 || len(n2.streams.streams) != 0 {
+		t.Error(n1.streams.streams, n2.streams.streams)
+	}
+	n2.streams.mutex.Unlock()
+	n1.streams.mutex.Unlock()
+}
+
+func Test_StreamPeerLost(t *testing.T) {
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	n1 := &Node{
+		Ctx:         ctx1,
+		Name:        "1/server/",
+		HTTPPort:    ":7310",
+		TCPPort:     ":9310",
+		Distributer: testRegistry.NewDistributer(),
+	}
+	n1.Init()
+	go n1.Run()
+	n1.WaitInit()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	n2 := &Node{
+		Ctx:         ctx2,
+		Name:        "2/server/",
+		HTTPPort:    ":7311",
+		TCPPort:     ":9311",
+		Distributer: testRegistry.NewDistributer(),
+	}
+	n2.Init()
+	go n2.Run()
+	n2.WaitInit()
+	//对端不读取也不发送
+	block := make(chan struct{})
+	n2.HandleStream(98, func(st *Stream) {
+		<-block
+	})
+	time.Sleep(500 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	recvStream, err := n1.OpenStream(ctx, 98)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendStream, err := n1.OpenStream(ctx, 98)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := recvStream.Recv()
+		recvErr <- err
+	}()
+	//超过接收窗口，阻塞在Send
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- sendStream.Send(make([]byte, 2*DefaultStreamWindow))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	//对端节点退出
+	cancel2()
+	for _, c := range []chan error{recvErr, sendErr} {
+		select {
+		case err := <-c:
+			if err != ErrStreamPeerLost {
+				t.Error(err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("对端退出后流未被重置。")
+		}
+	}
+	close(block)
+	cancel1()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func Test_extend(t *testing.T) {
+	ex := appendExtend(nil, extendReply, []byte{1, 2, 3, 4})
+	ex = appendExtend(ex, extendRequest, []byte{5, 6})
+	if !bytes.Equal(getExtend(ex, extendReply), []byte{1, 2, 3, 4}) || !bytes.Equal(getExtend(ex, extendRequest), []byte{5, 6}) {
+		t.Fatal(ex)
+	}
+	if getExtend(ex, 200) != nil || getExtend(ex[:3], extendReply) != nil {
+		t.Fatal(ex)
+	}
+	if r := removeExtend(ex, extendReply); !bytes.Equal(r, []byte{extendRequest, 2, 5, 6}) {
+		t.Fatal(r)
+	}
+	if !validExtend(ex) || validExtend(ex[:3]) || validExtend([]byte{0, 1, 9, 0}) {
+		t.Fatal(ex)
+	}
+}
+
 func testError(err error) {
 	fmt.Println(err.Error())
 }
@@ -183,7 +963,13 @@ func testReply(ctx *ContextMQ) {
 	testNodeTableMutex.Unlock()
 }
 
-/*
+func testKey(ctx *ContextMQ) {
+	text := strconv.Itoa(ctx.sidecar.MachineID) + " " + ctx.Key()
+	testNodeTableMutex.Lock()
+	testNodeTable = append(testNodeTable, text)
+	testNodeTableMutex.Unlock()
+}
+
 //管道（pipeline） ventilator  worker  sink  1 TO 1 TO 1
 
 var pipelineWg sync.WaitGroup
@@ -195,35 +981,77 @@ func Test_Pipeline1(t *testing.T) {
 	n3.Subscribe(72, testWorker)
 	n4.Subscribe(73, testSink)
 	time.Sleep(500 * time.Millisecond)
-	n1.Ventilator([]uint16{71, 72, 73}, []byte("Pipeline "+n1.sidecar.Name))
+	n1.Ventilator([]uint16{71, 72, 73}, []byte("Pipeline "+n1.sidecar.Name), 74, testError)
+	pipelineWg.Wait()
+	ctxExitFunc()
 	time.Sleep(50 * time.Millisecond)
+	testTableVerification(t, []string{
+		"2/server/ testWorker:Pipeline 1/server/ 0/3",
+		"3/server/ testWorker:Pipeline 1/server/->2/server/ 1/3",
+		"4/server/ testSink:Pipeline 1/server/->2/server/->3/server/ 2/3",
+	})
+}
+
+func Test_Pipeline2(t *testing.T) {
+	ctxExitFunc, n1, n2, n3, _ := test4Node(210)
+	n1.Subscribe(74, func(ctx *ContextMQ) {
+		stage, total := ctx.Stage()
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, fmt.Sprintf("fail:%s %d/%d", ctx.Request, stage, total))
+		testNodeTableMutex.Unlock()
+	})
+	n2.Subscribe(71, testWorker)
+	n3.Subscribe(72, func(ctx *ContextMQ) {
+		ctx.Fail([]byte("stage failed"), testError)
+	})
+	//阶段异常时通知发起节点
+	n3.Subscribe(75, func(ctx *ContextMQ) {
+		panic("boom")
+	})
+	time.Sleep(500 * time.Millisecond)
+	n1.Ventilator([]uint16{71, 72, 73}, []byte("Pipeline"), 74, testError)
+	time.Sleep(50 * time.Millisecond)
+	n1.Ventilator([]uint16{71, 75, 73}, []byte("Panic"), 74, testError)
+	n1.Ventilator([]uint16{71}, []byte("Pipeline"), 74, func(err error) {
+		if err != ErrPipelineStages {
+			t.Error(err)
+		}
+	})
+	time.Sleep(100 * time.Millisecond)
 	ctxExitFunc()
-	pipelineWg.Wait()
+	time.Sleep(50 * time.Millisecond)
 	testTableVerification(t, []string{
-		"2/server/ testWorker:Pipeline 1/server/",
-		"3/server/ testWorker:Pipeline 1/server/->2/server/",
-		"4/server/ testSink:Pipeline 1/server/->2/server/->3/server/",
+		"2/server/ testWorker:Pipeline 0/3",
+		"fail:stage failed 1/3",
+		"2/server/ testWorker:Panic 0/3",
+		"fail:panic: boom 1/3",
 	})
 }
+
 func testWorker(ctx *ContextMQ) {
-	text := ctx.sidecar.Name + " testWorker:" + string(ctx.Request)
+	stage, total := ctx.Stage()
+	text := fmt.Sprintf("%s testWorker:%s %d/%d", ctx.sidecar.Name, ctx.Request, stage, total)
 	testNodeTableMutex.Lock()
 	testNodeTable = append(testNodeTable, text)
 	testNodeTableMutex.Unlock()
 	d := make([]byte, len(ctx.Request))
 	copy(d, ctx.Request)
 	d = append(d, []byte("->"+ctx.sidecar.Name)...)
-	ctx.Next(d)
+	ctx.Next(d, testError)
 }
 
 func testSink(ctx *ContextMQ) {
-	text := ctx.sidecar.Name + " testSink:" + string(ctx.Request)
+	stage, total := ctx.Stage()
+	text := fmt.Sprintf("%s testSink:%s %d/%d", ctx.sidecar.Name, ctx.Request, stage, total)
 	testNodeTableMutex.Lock()
 	testNodeTable = append(testNodeTable, text)
 	testNodeTableMutex.Unlock()
-	pipelineWg.Done()
+	ctx.Next(nil, func(err error) {
+		if err == ErrPipelineEnd {
+			pipelineWg.Done()
+		}
+	})
 }
-*/
 
 //发布者-订阅者（pubsub publisher-subscriber）1 TO N
 func Test_PubSub1(t *testing.T) {
@@ -267,6 +1095,38 @@ func Test_PubSub2(t *testing.T) {
 	})
 }
 
+func Test_PubSubGroup(t *testing.T) {
+	ctxExitFunc, n1, n2, n3, n4 := test4Node(270)
+	var channel uint16 = 62
+	n1.SubscribeGroup(channel, "a", testReply)
+	n2.SubscribeGroup(channel, "a", testReply)
+	n3.SubscribeGroup(channel, "b", testReply)
+	n4.Subscribe(channel, testReply)
+	time.Sleep(1000 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		n1.Publish(channel, []byte("Group"), testError)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ctxExitFunc()
+	time.Sleep(50 * time.Millisecond)
+	count := make(map[string]int)
+	testNodeTableMutex.Lock()
+	for _, v := range testNodeTable {
+		count[v]++
+	}
+	testNodeTable = nil
+	testNodeTableMutex.Unlock()
+	for i, n := range []*Node{n1, n2, n3, n4} {
+		want := 4
+		if i < 2 {
+			want = 2
+		}
+		if c := count[strconv.Itoa(n.sidecar.MachineID)+" testReply:Group"]; c != want {
+			t.Fatal(i, count)
+		}
+	}
+}
+
 //总线（bus）   N VS N
 func Test_Bus1(t *testing.T) {
 	ctxExitFunc, n1, n2, n3, n4 := test4Node(150)
@@ -0,0 +1,46 @@
+package domi
+
+import (
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//orderedQueueSize 每个协程的队列长度
+const orderedQueueSize = 256
+
+type orderedWrapper struct {
+	processWrapper
+	executor *util.KeyedExecutor
+}
+
+//SubscribeOrdered 订阅频道，处理函数在workers个协程中执行，可以阻塞，相同路由键（ContextMQ.Key）的消息按到达顺序依次处理，
+//不同键的消息并发处理，无路由键的消息视为同一个键。与NotifyKey、CallKey配合时，同一发送方同一键的消息端到端先进先出：
+//发送方按一致性哈希固定发往同一节点，会话按写入顺序发送，接收方按键依次处理。节点关闭时停止。
+func (n *Node) SubscribeOrdered(channel uint16, workers int, f func(*ContextMQ)) {
+	ow := orderedWrapper{
+		processWrapper: processWrapper{n: n, f: f},
+		executor:       util.NewKeyedExecutor(workers, orderedQueueSize),
+	}
+	if err := n.handleChannel(channel, n, ow.orderedWrapper); err != nil {
+		ow.executor.Close()
+		n.Logger.Error("SubscribeOrdered|", err.Error(), channel)
+		return
+	}
+	go func() {
+		<-n.Ctx.Done()
+		ow.executor.Close()
+	}()
+	n.sidecar.SetChannel(uint16(n.sidecar.MachineID), channel, 3)
+}
+
+//orderedWrapper 复制帧后按路由键交给执行器，队列满时阻塞读协程。
+func (ow orderedWrapper) orderedWrapper(s transport.Session) error {
+	all := s.GetFrameSlice().GetAll()
+	buf := make([]byte, len(all))
+	copy(buf, all)
+	fs := transport.DecodeByBytes(buf)
+	if !ow.executor.Submit(getExtend(fs.GetExtend(), extendKey), func() { ow.process(fs) }) {
+		ow.n.Logger.Error("orderedWrapper|节点已关闭，丢弃频道：", fs.GetFrameType())
+	}
+	return nil
+}
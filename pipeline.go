@@ -0,0 +1,132 @@
+package domi
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//定义错误
+var (
+	ErrPipelineStages = errors.New("domi.Ventilator|频道数量应在2至125之间。")
+	ErrPipelineNone   = errors.New("domi.Next|请求不属于pipeline。")
+	ErrPipelineEnd    = errors.New("domi.Next|最后一个服务不得使用Next。")
+)
+
+/*
+pipeline 路由字段（extendPipeline）：
+  [xx]        [xx]        [x]         [xx]...
+|(uint16)  ||(uint16)  ||(uint8)   ||(uint16)...
+| 2-byte   || 2-byte   || 1-byte   || 2N-byte
+----------------------------------------------
+ 发起机器id   错误频道     当前阶段     各阶段频道
+*/
+
+//maxPipelineStages 扩展字段长度不超过255
+const maxPipelineStages = (255 - 5) / 2
+
+//Ventilator 开始 pipeline模式，数据依次经过channels中的频道，中间阶段调用Next传递给下一阶段，最后一个阶段不可调用Next。
+//任一阶段调用Fail、Next失败或处理函数异常时，错误发往发起节点的fail频道，ContextMQ.Stage返回出错的阶段。
+func (n *Node) Ventilator(channels []uint16, data []byte, fail uint16, reject func(error)) {
+	l := len(channels)
+	if l < 2 || l > maxPipelineStages {
+		reject(ErrPipelineStages)
+		return
+	}
+	v := make([]byte, 5+2*l)
+	util.CopyUint16(v[:2], uint16(n.sidecar.MachineID))
+	util.CopyUint16(v[2:4], fail)
+	for i := 0; i < l; i++ {
+		util.CopyUint16(v[5+2*i:7+2*i], channels[i])
+	}
+	fs := transport.NewFrameSlice(channels[0], data, appendExtend(nil, extendPipeline, v))
+	n.sidecar.AskOne(channels[0], fs, n.deadLetterReject(channels[0], fs, reject))
+}
+
+//pipeline 取得pipeline路由字段，不属于pipeline时返回nil。
+func (c *ContextMQ) pipeline() []byte {
+	return getPipeline(c.ex)
+}
+
+//getPipeline 由扩展字段取得pipeline路由字段，不属于pipeline时返回nil。
+func getPipeline(ex []byte) []byte {
+	v := getExtend(ex, extendPipeline)
+	if len(v) < 5 || (len(v)-5)%2 != 0 || int(v[4]) >= (len(v)-5)/2 {
+		return nil
+	}
+	return v
+}
+
+//Stage 当前所处的阶段（从0开始）及阶段总数，不属于pipeline时返回 -1,0。
+func (c *ContextMQ) Stage() (int, int) {
+	v := c.pipeline()
+	if v == nil {
+		return -1, 0
+	}
+	return int(v[4]), (len(v) - 5) / 2
+}
+
+//Stages pipeline各阶段的频道
+func (c *ContextMQ) Stages() []uint16 {
+	v := c.pipeline()
+	if v == nil {
+		return nil
+	}
+	s := make([]uint16, (len(v)-5)/2)
+	for i := range s {
+		s[i] = util.BytesToUint16(v[5+2*i : 7+2*i])
+	}
+	return s
+}
+
+//Next 下一个 pipeline模式，将data交给下一阶段，失败时同时通知发起节点。
+func (c *ContextMQ) Next(data []byte, reject func(error)) {
+	v := c.pipeline()
+	if v == nil {
+		reject(ErrPipelineNone)
+		return
+	}
+	stage := int(v[4]) + 1
+	if stage >= (len(v)-5)/2 {
+		reject(ErrPipelineEnd)
+		return
+	}
+	nv := make([]byte, len(v))
+	copy(nv, v)
+	nv[4] = uint8(stage)
+	channel := util.BytesToUint16(nv[5+2*stage : 7+2*stage])
+	fs := transport.NewFrameSlice(channel, data, appendExtend(nil, extendPipeline, nv))
+	//回调时c.ex可能已被覆盖，使用拷贝nv。
+	nv[4] = uint8(stage - 1)
+	n := c.Node
+	var once sync.Once
+	n.sidecar.AskOne(channel, fs, func(err error) {
+		once.Do(func() {
+			//通知发起节点失败时只记录日志，reject只调用一次。
+			n.pipelineFail(nv, []byte(err.Error()), func(e error) {
+				n.Logger.Error("Next|", e.Error())
+			})
+			reject(err)
+		})
+	})
+}
+
+//Fail 将当前阶段的错误发往发起节点的错误频道
+func (c *ContextMQ) Fail(reason []byte, reject func(error)) {
+	v := c.pipeline()
+	if v == nil {
+		reject(ErrPipelineNone)
+		return
+	}
+	c.Node.pipelineFail(v, reason, reject)
+}
+
+//pipelineFail 按路由字段v将错误发往发起节点
+func (n *Node) pipelineFail(v, reason []byte, reject func(error)) {
+	id := util.BytesToUint16(v[:2])
+	channel := util.BytesToUint16(v[2:4])
+	fs := transport.NewFrameSlice(channel, reason, appendExtend(nil, extendPipeline, v))
+	n.sidecar.Specify(id, channel, fs, reject)
+}
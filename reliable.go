@@ -0,0 +1,219 @@
+package domi
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//定义错误
+var (
+	ErrNotAcked    = errors.New("domi.NotifyReliable|超过最大投递次数，未收到确认。")
+	ErrNotReliable = errors.New("domi.Ack|请求不是可靠投递。")
+)
+
+//ReliableConfigure 可靠投递配置
+type ReliableConfigure struct {
+	AckTimeout  time.Duration //等待确认的时间，超时后重新投递，默认1秒。
+	MaxAttempts int           //最大投递次数，默认3。
+	DedupWindow time.Duration //接收方去重窗口，默认5分钟。
+}
+
+//reliableMessage 等待确认的消息
+type reliableMessage struct {
+	channel  uint16
+	data     []byte
+	attempts int
+	deadline time.Time
+	tried    []uint16 //已投递的节点
+	reject   func(error)
+}
+
+type dedupKey struct {
+	from uint16
+	id   uint64
+}
+
+//reliableTable 发送方保留未确认的消息，接收方记录已确认的消息用于去重。
+type reliableTable struct {
+	ReliableConfigure
+	sequence uint64
+	mutex    sync.Mutex
+	pending  map[uint64]*reliableMessage
+	acked    map[dedupKey]time.Time
+	runOnce  sync.Once
+}
+
+func newReliableTable(rc ReliableConfigure) *reliableTable {
+	if rc.AckTimeout <= 0 {
+		rc.AckTimeout = time.Second
+	}
+	if rc.MaxAttempts <= 0 {
+		rc.MaxAttempts = 3
+	}
+	if rc.DedupWindow <= 0 {
+		rc.DedupWindow = 5 * time.Minute
+	}
+	return &reliableTable{
+		ReliableConfigure: rc,
+		//以时间为种子，避免重启后消息id重复。
+		sequence: uint64(time.Now().UnixNano()),
+		pending:  make(map[uint64]*reliableMessage, 1024),
+		acked:    make(map[dedupKey]time.Time, 1024),
+	}
+}
+
+//NotifyReliable 可靠投递，至少一次。消息保留至收到ContextMQ.Ack，超时未确认时投递给频道中的其它节点，
+//超过最大投递次数后调用reject(ErrNotAcked)。
+func (n *Node) NotifyReliable(channel uint16, data []byte, reject func(error)) {
+	rt := n.reliable
+	rt.runOnce.Do(func() {
+		go n.redeliver()
+	})
+	m := &reliableMessage{
+		channel: channel,
+		data:    make([]byte, len(data)),
+	}
+	copy(m.data, data)
+	//超过最大投递次数时发往死信频道
+	m.reject = n.deadLetterReject(channel, transport.NewFrameSlice(channel, m.data, nil), reject)
+	id := atomic.AddUint64(&rt.sequence, 1)
+	rt.mutex.Lock()
+	rt.pending[id] = m
+	d := n.prepare(id, m)
+	rt.mutex.Unlock()
+	n.deliver(d)
+}
+
+//delivery 一次投递，持锁时生成，释放锁后发送。
+type delivery struct {
+	m     *reliableMessage
+	fs    transport.FrameSlice
+	tried []uint16
+}
+
+//prepare 更新投递次数及超时时间，复制帧及已投递的节点，需持有锁。
+func (n *Node) prepare(id uint64, m *reliableMessage) delivery {
+	m.attempts++
+	m.deadline = time.Now().Add(n.reliable.AckTimeout)
+	v := make([]byte, 11)
+	util.CopyUint16(v[:2], uint16(n.sidecar.MachineID))
+	util.CopyInt64(v[2:10], int64(id))
+	v[10] = uint8(m.attempts)
+	return delivery{
+		m:     m,
+		fs:    transport.NewFrameSlice(m.channel, m.data, appendExtend(nil, extendAck, v)),
+		tried: append([]uint16(nil), m.tried...),
+	}
+}
+
+//deliver 投递，不可持有锁。发送失败的消息等待超时后重新投递。
+func (n *Node) deliver(d delivery) {
+	if to := n.sidecar.AskOther(d.m.channel, d.tried, d.fs, func(error) {}); to >= 0 {
+		rt := n.reliable
+		rt.mutex.Lock()
+		d.m.tried = append(d.m.tried, uint16(to))
+		rt.mutex.Unlock()
+	}
+}
+
+//redeliver 定时重新投递超时的消息，清理过期的去重记录。
+func (n *Node) redeliver() {
+	rt := n.reliable
+	ticker := time.NewTicker(rt.AckTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			var failed []*reliableMessage
+			var deliveries []delivery
+			rt.mutex.Lock()
+			for id, m := range rt.pending {
+				if now.Before(m.deadline) {
+					continue
+				}
+				if m.attempts >= rt.MaxAttempts {
+					delete(rt.pending, id)
+					failed = append(failed, m)
+					continue
+				}
+				deliveries = append(deliveries, n.prepare(id, m))
+			}
+			for k, t := range rt.acked {
+				if now.Sub(t) > rt.DedupWindow {
+					delete(rt.acked, k)
+				}
+			}
+			rt.mutex.Unlock()
+			for _, d := range deliveries {
+				n.deliver(d)
+			}
+			for _, m := range failed {
+				m.reject(ErrNotAcked)
+			}
+		case <-n.Ctx.Done():
+			return
+		}
+	}
+}
+
+//ackWrapper 收到确认，移除保留的消息。
+func (n *Node) ackWrapper(s transport.Session) error {
+	v := getExtend(s.GetFrameSlice().GetExtend(), extendAck)
+	if len(v) != 11 {
+		return errors.New("ackWrapper|确认未包含消息id。")
+	}
+	rt := n.reliable
+	rt.mutex.Lock()
+	delete(rt.pending, uint64(util.BytesToInt64(v[2:10])))
+	rt.mutex.Unlock()
+	return nil
+}
+
+//duplicate 接收方，消息在去重窗口内已确认过。
+func (n *Node) duplicate(v []byte) bool {
+	k := dedupKey{from: util.BytesToUint16(v[:2]), id: uint64(util.BytesToInt64(v[2:10]))}
+	rt := n.reliable
+	rt.mutex.Lock()
+	t, ok := rt.acked[k]
+	rt.mutex.Unlock()
+	return ok && time.Since(t) <= rt.DedupWindow
+}
+
+//sendAck 回复确认
+func (n *Node) sendAck(v []byte, reject func(error)) {
+	ex := make([]byte, len(v))
+	copy(ex, v)
+	fs := transport.NewFrameSlice(transport.FrameTypeAck, nil, appendExtend(nil, extendAck, ex))
+	n.sidecar.Specify(util.BytesToUint16(v[:2]), transport.FrameTypeAck, fs, reject)
+}
+
+//Ack 确认可靠投递的消息已处理，需在处理函数返回前调用。去重窗口内重复投递到本节点的消息不再交给处理函数。
+func (c *ContextMQ) Ack(reject func(error)) {
+	v := getExtend(c.ex, extendAck)
+	if len(v) != 11 {
+		reject(ErrNotReliable)
+		return
+	}
+	c.markAcked(v)
+	c.sendAck(v, reject)
+}
+
+//markAcked 接收方记录已确认的消息
+func (n *Node) markAcked(v []byte) {
+	k := dedupKey{from: util.BytesToUint16(v[:2]), id: uint64(util.BytesToInt64(v[2:10]))}
+	rt := n.reliable
+	rt.mutex.Lock()
+	rt.acked[k] = time.Now()
+	rt.mutex.Unlock()
+}
+
+//Redelivered 可靠投递的消息是否为重新投递
+func (c *ContextMQ) Redelivered() bool {
+	v := getExtend(c.ex, extendAck)
+	return len(v) == 11 && v[10] > 1
+}
@@ -0,0 +1,162 @@
+package domi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//ErrRequestClosed 定义错误
+var ErrRequestClosed = errors.New("domi.Request|节点已关闭。")
+
+//Future 异步请求的结果
+type Future struct {
+	done  chan struct{}
+	reply []byte
+	from  uint16 //回复节点的机器id
+	err   error
+}
+
+//Done 完成时关闭
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//Get 阻塞，等待回复。
+func (f *Future) Get() ([]byte, error) {
+	<-f.done
+	return f.reply, f.err
+}
+
+//From 回复节点的机器id
+func (f *Future) From() uint16 {
+	<-f.done
+	return f.from
+}
+
+//requestTable 等待回复的请求表
+type requestTable struct {
+	sequence uint64
+	mutex    sync.Mutex
+	pending  map[uint64]*Future
+	gathers  map[uint64]*gatherCall
+}
+
+func newRequestTable() *requestTable {
+	return &requestTable{
+		pending: make(map[uint64]*Future, 1024),
+		gathers: make(map[uint64]*gatherCall, 64),
+	}
+}
+
+//addGather 登记Gather，与请求共用请求id。
+func (rt *requestTable) addGather(g *gatherCall) uint64 {
+	id := atomic.AddUint64(&rt.sequence, 1)
+	rt.mutex.Lock()
+	rt.gathers[id] = g
+	rt.mutex.Unlock()
+	return id
+}
+
+//removeGather 移除Gather
+func (rt *requestTable) removeGather(id uint64) {
+	rt.mutex.Lock()
+	delete(rt.gathers, id)
+	rt.mutex.Unlock()
+}
+
+//getGather 取得Gather
+func (rt *requestTable) getGather(id uint64) *gatherCall {
+	rt.mutex.Lock()
+	g := rt.gathers[id]
+	rt.mutex.Unlock()
+	return g
+}
+
+//add 登记请求，返回请求id
+func (rt *requestTable) add(f *Future) uint64 {
+	id := atomic.AddUint64(&rt.sequence, 1)
+	rt.mutex.Lock()
+	rt.pending[id] = f
+	rt.mutex.Unlock()
+	return id
+}
+
+//remove 移除请求，只有移除成功的一方可以完成Future。
+func (rt *requestTable) remove(id uint64) *Future {
+	rt.mutex.Lock()
+	f, ok := rt.pending[id]
+	if ok {
+		delete(rt.pending, id)
+	}
+	rt.mutex.Unlock()
+	return f
+}
+
+//complete 完成请求
+func (rt *requestTable) complete(id uint64, reply []byte, from uint16, err error) {
+	if f := rt.remove(id); f != nil {
+		f.reply = reply
+		f.from = from
+		f.err = err
+		close(f.done)
+	}
+}
+
+//Request 请求 request-reply模式, 1 Vs 1，阻塞至收到回复，或ctx超时、取消。
+func (n *Node) Request(ctx context.Context, channel uint16, data []byte) ([]byte, error) {
+	return n.RequestAsync(ctx, channel, data).Get()
+}
+
+//RequestAsync 异步请求 request-reply模式, 1 Vs 1，ctx超时或取消时Future返回ctx.Err()。
+func (n *Node) RequestAsync(ctx context.Context, channel uint16, data []byte) *Future {
+	f := &Future{done: make(chan struct{})}
+	id := n.requests.add(f)
+	v := make([]byte, 10)
+	util.CopyUint16(v[:2], uint16(n.sidecar.MachineID))
+	util.CopyInt64(v[2:10], int64(id))
+	fs := transport.NewFrameSlice(channel, data, appendExtend(nil, extendRequest, v))
+	to := n.sidecar.AskOne(channel, fs, func(err error) {
+		n.requests.complete(id, nil, 0, err)
+	})
+	//统计未完成的请求数，供负载均衡使用。
+	if to >= 0 {
+		n.sidecar.AddOutstanding(uint16(to), 1)
+	}
+	go func() {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			n.requests.complete(id, nil, 0, ctx.Err())
+		case <-n.Ctx.Done():
+			n.requests.complete(id, nil, 0, ErrRequestClosed)
+		}
+		if to >= 0 {
+			n.sidecar.AddOutstanding(uint16(to), -1)
+		}
+	}()
+	return f
+}
+
+//replyWrapper 收到回复，按请求id交给等待的请求，回复中的机器id为回复节点。
+func (n *Node) replyWrapper(s transport.Session) error {
+	fs := s.GetFrameSlice()
+	v := getExtend(fs.GetExtend(), extendRequest)
+	if len(v) != 10 {
+		return errors.New("replyWrapper|回复未包含请求id。")
+	}
+	fd := fs.GetData()
+	reply := make([]byte, len(fd))
+	copy(reply, fd)
+	id := uint64(util.BytesToInt64(v[2:10]))
+	if g := n.requests.getGather(id); g != nil {
+		g.add(Reply{From: util.BytesToUint16(v[:2]), Data: reply})
+		return nil
+	}
+	n.requests.complete(id, reply, util.BytesToUint16(v[:2]), nil)
+	return nil
+}
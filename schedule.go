@@ -0,0 +1,300 @@
+package domi
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//定义定时消息日志的记录类型
+const (
+	scheduleAdd    uint8 = 1 + iota //1字节类型、8字节消息id、8字节到期时间、2字节频道、数据
+	scheduleRemove                  //1字节类型、8字节消息id
+)
+
+//scheduleConsumer 定时消息日志中有效记录的起始偏移量
+const scheduleConsumer = "schedule"
+
+//scheduleCompactRecords 日志中无效记录超过该数量时压缩
+const scheduleCompactRecords = 4096
+
+//定义错误
+var (
+	ErrScheduleClosed    = errors.New("domi.NotifyAt|节点已关闭。")
+	ErrScheduleRetention = errors.New("domi.openSchedule|定时消息日志不可设置RetentionSize、RetentionAge。")
+)
+
+//ScheduleConfigure 定时消息配置
+type ScheduleConfigure struct {
+	Tick time.Duration      //时间轮精度，默认10毫秒。
+	WAL  *util.WALConfigure //非nil时未到期的定时消息写入日志，重启后恢复。日志由压缩清理，不可设置保留大小、时间。
+}
+
+//scheduledMessage 未到期的定时消息
+type scheduledMessage struct {
+	channel uint16
+	at      time.Time
+	data    []byte
+	reject  func(error)
+}
+
+//scheduler 定时消息，由时间轮按到期时间投递。
+type scheduler struct {
+	ScheduleConfigure
+	sequence uint64
+	mutex    sync.Mutex
+	wheel    *util.TimingWheel
+	pending  map[uint64]*scheduledMessage
+	due      []uint64 //本次推进到期的消息id
+	wal      *util.WAL
+	records  int //日志中自上次压缩以来的记录数
+	closed   bool
+}
+
+func newScheduler(sc ScheduleConfigure) *scheduler {
+	if sc.Tick <= 0 {
+		sc.Tick = 10 * time.Millisecond
+	}
+	return &scheduler{
+		ScheduleConfigure: sc,
+		//以时间为种子，避免重启后消息id重复。
+		sequence: uint64(time.Now().UnixNano()),
+		wheel:    util.NewTimingWheel(sc.Tick, 4, time.Now()),
+		pending:  make(map[uint64]*scheduledMessage, 1024),
+	}
+}
+
+//NotifyAt 定时投递，到期时发往频道中的一个节点，返回消息id，可用CancelNotify取消。
+//节点关闭时未到期的消息调用reject(ErrScheduleClosed)，配置了Node.Schedule.WAL时保留至重启后投递。
+func (n *Node) NotifyAt(channel uint16, data []byte, at time.Time, reject func(error)) uint64 {
+	sc := n.scheduler
+	m := &scheduledMessage{
+		channel: channel,
+		at:      at,
+		data:    make([]byte, len(data)),
+		reject:  reject,
+	}
+	copy(m.data, data)
+	id := atomic.AddUint64(&sc.sequence, 1)
+	sc.mutex.Lock()
+	if sc.closed {
+		sc.mutex.Unlock()
+		reject(ErrScheduleClosed)
+		return id
+	}
+	n.addScheduled(id, m)
+	if sc.wal != nil {
+		if _, err := sc.wal.Append(encodeScheduleAdd(id, m)); err != nil {
+			n.Logger.Error("NotifyAt|", err.Error())
+		}
+		sc.records++
+	}
+	sc.mutex.Unlock()
+	return id
+}
+
+//NotifyAfter 延时投递，见NotifyAt。
+func (n *Node) NotifyAfter(channel uint16, data []byte, delay time.Duration, reject func(error)) uint64 {
+	return n.NotifyAt(channel, data, time.Now().Add(delay), reject)
+}
+
+//CancelNotify 取消未到期的定时消息，已投递或不存在时返回false。
+func (n *Node) CancelNotify(id uint64) bool {
+	sc := n.scheduler
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if _, ok := sc.pending[id]; !ok {
+		return false
+	}
+	n.removeScheduled(id)
+	return true
+}
+
+//addScheduled 加入时间轮，需持有锁。
+func (n *Node) addScheduled(id uint64, m *scheduledMessage) {
+	sc := n.scheduler
+	sc.pending[id] = m
+	sc.wheel.Add(id, m.at, func() {
+		sc.due = append(sc.due, id)
+	})
+}
+
+//removeScheduled 移除并记录日志，需持有锁。
+func (n *Node) removeScheduled(id uint64) {
+	sc := n.scheduler
+	delete(sc.pending, id)
+	sc.wheel.Remove(id)
+	n.logScheduleRemove(id)
+}
+
+//logScheduleRemove 写入移除记录，需持有锁。
+func (n *Node) logScheduleRemove(id uint64) {
+	sc := n.scheduler
+	if sc.wal != nil {
+		v := make([]byte, 9)
+		v[0] = scheduleRemove
+		binary.LittleEndian.PutUint64(v[1:], id)
+		if _, err := sc.wal.Append(v); err != nil {
+			n.Logger.Error("removeScheduled|", err.Error())
+		}
+		sc.records++
+	}
+}
+
+func encodeScheduleAdd(id uint64, m *scheduledMessage) []byte {
+	v := make([]byte, 19+len(m.data))
+	v[0] = scheduleAdd
+	binary.LittleEndian.PutUint64(v[1:9], id)
+	binary.LittleEndian.PutUint64(v[9:17], uint64(m.at.UnixNano()))
+	binary.LittleEndian.PutUint16(v[17:19], m.channel)
+	copy(v[19:], m.data)
+	return v
+}
+
+//openSchedule 打开日志，恢复未到期的定时消息。未到期消息的记录须留在日志中，按大小、时间保留会删除它们，故拒绝。
+func (n *Node) openSchedule() error {
+	sc := n.scheduler
+	if sc.WAL.RetentionSize > 0 || sc.WAL.RetentionAge > 0 {
+		return ErrScheduleRetention
+	}
+	wal, err := util.OpenWAL(*sc.WAL)
+	if err != nil {
+		return err
+	}
+	offset, err := wal.Committed(scheduleConsumer)
+	if err != nil {
+		wal.Close()
+		return err
+	}
+	first, next := wal.Offsets()
+	if offset < first {
+		offset = first
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	for ; offset < next; offset++ {
+		v, err := wal.Read(offset)
+		if err != nil {
+			wal.Close()
+			return err
+		}
+		switch {
+		case len(v) >= 19 && v[0] == scheduleAdd:
+			id := binary.LittleEndian.Uint64(v[1:9])
+			m := &scheduledMessage{
+				channel: binary.LittleEndian.Uint16(v[17:19]),
+				at:      time.Unix(0, int64(binary.LittleEndian.Uint64(v[9:17]))),
+				data:    v[19:],
+				reject:  n.logScheduleError,
+			}
+			n.addScheduled(id, m)
+			if id > sc.sequence {
+				sc.sequence = id
+			}
+		case len(v) == 9 && v[0] == scheduleRemove:
+			id := binary.LittleEndian.Uint64(v[1:9])
+			delete(sc.pending, id)
+			sc.wheel.Remove(id)
+		}
+	}
+	sc.wal = wal
+	sc.records = int(next - first)
+	return nil
+}
+
+//compactSchedule 无效记录过多时，将未到期的消息重新写入日志末尾，删除之前的段文件，需持有锁。
+func (n *Node) compactSchedule() {
+	sc := n.scheduler
+	if sc.wal == nil || sc.records-len(sc.pending) < scheduleCompactRecords {
+		return
+	}
+	_, start := sc.wal.Offsets()
+	for id, m := range sc.pending {
+		if _, err := sc.wal.Append(encodeScheduleAdd(id, m)); err != nil {
+			n.Logger.Error("compactSchedule|", err.Error())
+			return
+		}
+	}
+	if err := sc.wal.Commit(scheduleConsumer, start); err != nil {
+		n.Logger.Error("compactSchedule|", err.Error())
+		return
+	}
+	sc.wal.Trim(start)
+	sc.records = len(sc.pending)
+}
+
+func (n *Node) logScheduleError(err error) {
+	n.Logger.Error("NotifyAt|", err.Error())
+}
+
+//schedule 推进时间轮，投递到期的消息。移除记录在消息交给发送后写入，写入前崩溃时重启后重新投递（至少一次）。
+func (n *Node) schedule() {
+	sc := n.scheduler
+	ready := make(chan struct{})
+	go func() {
+		n.sidecar.WaitInit()
+		close(ready)
+	}()
+	select {
+	case <-ready:
+	case <-n.Ctx.Done():
+		n.closeSchedule()
+		return
+	}
+	ticker := time.NewTicker(sc.Tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			var due []*scheduledMessage
+			var ids []uint64
+			sc.mutex.Lock()
+			sc.wheel.Advance(now)
+			for _, id := range sc.due {
+				due = append(due, sc.pending[id])
+				ids = append(ids, id)
+				delete(sc.pending, id)
+			}
+			sc.due = sc.due[:0]
+			sc.mutex.Unlock()
+			for _, m := range due {
+				fs := transport.NewFrameSlice(m.channel, m.data, nil)
+				n.sidecar.AskOne(m.channel, fs, n.deadLetterReject(m.channel, fs, m.reject))
+			}
+			sc.mutex.Lock()
+			for _, id := range ids {
+				n.logScheduleRemove(id)
+			}
+			n.compactSchedule()
+			sc.mutex.Unlock()
+		case <-n.Ctx.Done():
+			n.closeSchedule()
+			return
+		}
+	}
+}
+
+//closeSchedule 节点关闭，未持久化的消息调用reject。
+func (n *Node) closeSchedule() {
+	sc := n.scheduler
+	sc.mutex.Lock()
+	sc.closed = true
+	var dropped []*scheduledMessage
+	if sc.wal == nil {
+		for _, m := range sc.pending {
+			dropped = append(dropped, m)
+		}
+		sc.pending = make(map[uint64]*scheduledMessage)
+	} else {
+		sc.wal.Close()
+	}
+	sc.mutex.Unlock()
+	for _, m := range dropped {
+		m.reject(ErrScheduleClosed)
+	}
+}
@@ -1,32 +1,63 @@
-﻿package domi
+package domi
 
 import (
 	"errors"
+	"fmt"
+	"runtime"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/duomi520/domi/transport"
 	"github.com/duomi520/domi/util"
 )
 
-var globalContextMQHandler [65536]func(*ContextMQ)
+//serialSequence serial的序号，用于区分指标。
+var serialSequence uint32
+
+//serialShortPark 休眠后在该时间内被写入方唤醒，视为自旋不足。
+const serialShortPark = 10 * time.Millisecond
+
+//serialReady 已关闭的通道，Run不休眠时代替唤醒通道。
+var serialReady = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
 
 //Serial 串行处理
 //一个协程处理一个serial,以避免锁的问题，同时减少协程切换，提高cpu利用率。
-//按时间轮来分配cpu，不适用于cpu密集计算或长IO场景。
+//RingBuffer为空时先自旋，再休眠至有消息写入，不适用于cpu密集计算或长IO场景。
 type Serial struct {
-	SnippetDuration time.Duration //定时调用的时间间隔。
+	SnippetDuration time.Duration //关闭时等待的时间单位，默认10微秒。
+	SpinCount       int           //休眠前自旋（让出cpu）的最大次数，默认64，负数时不自旋。
 	channelMap      map[uint16]uint16
+	handlers        map[uint16]func(*ContextMQ) //各serial独立的处理函数表，只在Run协程中读取。
 	bags            []*bag
+	joins           []*keyedBag
 
 	RingBufferSize uint64 //RingBuffer缓存大小
 	util.RingBuffer
 
 	*Node
 
-	rejectFuncChan  chan errAndFunc
-	unsubscribeChan chan []uint16
+	rejectFuncChan chan errAndFunc
+
+	changeMutex  sync.Mutex
+	changes      []func() //待执行的订阅变更及定时器操作，不限长度，可在处理函数中调用。
+	changeSignal chan struct{}
+
+	TimerTick     time.Duration //定时器精度，默认1毫秒。
+	wheel         *util.TimingWheel
+	timerSequence uint64
+
+	spinLimit int32         //当前自旋次数上限	原子操作
+	sleeping  uint32        //1 Run协程准备休眠，写入方负责唤醒。
+	wakeChan  chan struct{} //唤醒信号
+	wakeups   *util.Counter //休眠后被唤醒的次数
+
+	metricsLabels string
 
 	stopChan  chan struct{} //退出信号
 	closeOnce sync.Once
@@ -46,56 +77,114 @@ func (s *Serial) Init() {
 	if s.SnippetDuration == 0 {
 		s.SnippetDuration = 10 * time.Microsecond
 	}
+	if s.SpinCount == 0 {
+		s.SpinCount = 64
+	}
 	if s.RingBufferSize == 0 {
 		s.RingBufferSize = 2097152 //默认2^21
 	}
 	s.InitRingBuffer(s.RingBufferSize)
 	s.channelMap = make(map[uint16]uint16, 256)
+	s.handlers = make(map[uint16]func(*ContextMQ), 256)
 	s.bags = make([]*bag, 0, 64)
 	s.rejectFuncChan = make(chan errAndFunc, 1024)
-	s.unsubscribeChan = make(chan []uint16, 128)
+	s.changeSignal = make(chan struct{}, 1)
+	if s.TimerTick <= 0 {
+		s.TimerTick = time.Millisecond
+	}
+	s.wheel = util.NewTimingWheel(s.TimerTick, 4, time.Now())
+	s.wakeChan = make(chan struct{}, 1)
 	s.stopChan = make(chan struct{})
 	s.SetState(util.StatePause)
+	s.metricsLabels = fmt.Sprintf(`machine="%d",serial="%d"`, s.sidecar.MachineID, atomic.AddUint32(&serialSequence, 1))
+	util.DefaultMetrics.SetGauge("domi_serial_ring_buffer_used_bytes", "Bytes waiting in the serial RingBuffer.", s.metricsLabels, func() float64 {
+		return float64(s.Len())
+	})
+	util.DefaultMetrics.SetGauge("domi_serial_ring_buffer_size_bytes", "Capacity of the serial RingBuffer.", s.metricsLabels, func() float64 {
+		return float64(s.Cap())
+	})
+	s.wakeups = util.DefaultMetrics.NewCounter("domi_serial_wakeups_total", "Number of times the serial goroutine woke up from sleep.", s.metricsLabels)
+}
+
+//Wakeups Run协程休眠后被唤醒的次数，空闲时应接近不变。
+func (s *Serial) Wakeups() uint64 {
+	return s.wakeups.Get()
 }
 
 //WaitInit 准备好
 func (s *Serial) WaitInit() {}
 
-//Run 定时工作
+//Run 处理消息，RingBuffer为空时自旋，仍为空时休眠，由写入方或定时器唤醒。
 func (s *Serial) Run() {
 	defer func() {
 		if recover := recover(); recover != nil {
 			s.Logger.Error("Run|异常拦截：", recover, string(debug.Stack()))
 		}
 	}()
-	snippet := time.NewTicker(s.SnippetDuration)
+	//运行前的订阅先生效
+	s.applyChanges()
 	s.SetState(util.StateWork)
+	//spinLimit 自适应：自旋期间等到消息或休眠后很快被唤醒时加倍，长时间休眠或由定时器唤醒时减半。
+	spinLimit := s.SpinCount
+	idle := 0
+	var parkedAt time.Time
+	atomic.StoreInt32(&s.spinLimit, int32(spinLimit))
+	//休眠至最早的定时器到期
+	expire := time.NewTimer(time.Hour)
+	expire.Stop()
 	for {
+		worked := s.assignmentTask()
+		s.wheel.Advance(time.Now())
+		wake := (<-chan struct{})(serialReady)
+		var timeout <-chan time.Time
+		switch {
+		case worked:
+			if idle > 0 {
+				spinLimit = s.growSpin(spinLimit)
+				atomic.StoreInt32(&s.spinLimit, int32(spinLimit))
+			}
+			idle = 0
+		case idle < spinLimit:
+			idle++
+			runtime.Gosched()
+		default:
+			//先声明休眠再检查，写入方在写入后检查，两者至少有一方看到对方。
+			atomic.StoreUint32(&s.sleeping, 1)
+			if s.Len() > 0 {
+				atomic.StoreUint32(&s.sleeping, 0)
+				break
+			}
+			//有定时器时休眠至下一次到期，已到期时不休眠。
+			if at, ok := s.wheel.NextExpire(); ok {
+				d := time.Until(at)
+				if d <= 0 {
+					atomic.StoreUint32(&s.sleeping, 0)
+					break
+				}
+				expire.Reset(d)
+				timeout = expire.C
+			}
+			wake = s.wakeChan
+			parkedAt = time.Now()
+			idle = 0
+		}
+		woken := false
 		select {
-		case <-snippet.C:
-			s.assignmentTask()
+		case <-wake:
+			woken = wake != serialReady
+		case <-timeout:
 		case rejectFunc := <-s.rejectFuncChan:
 			rejectFunc.f(rejectFunc.err)
-		case u := <-s.unsubscribeChan:
-			l := len(s.bags)
-			if l > 0 {
-				for i := 0; i < l; i++ {
-					if util.Uint16Equal(u, s.bags[i].channels) {
-						copy(s.bags[i:l-1], s.bags[i+1:])
-						s.bags = s.bags[:l-1]
-						break
-					}
-				}
-			}
-			for _, v := range u {
-				delete(s.channelMap, v)
-			}
+		case <-s.changeSignal:
+			s.applyChanges()
 		case <-s.Node.sidecar.Ctx.Done():
 			s.Close()
 		case <-s.stopChan:
-			snippet.Stop()
+			util.DefaultMetrics.Remove("domi_serial_ring_buffer_used_bytes", s.metricsLabels)
+			util.DefaultMetrics.Remove("domi_serial_ring_buffer_size_bytes", s.metricsLabels)
+			util.DefaultMetrics.Remove("domi_serial_wakeups_total", s.metricsLabels)
 			for k := range s.channelMap {
-				s.Unsubscribe(k)
+				s.Node.unsubscribe(k, s)
 			}
 			s.assignmentTask()
 			//5分钟后强制释放，如果部分Handler时间超过5分钟，最后释放时会产生异常。
@@ -106,25 +195,63 @@ func (s *Serial) Run() {
 					}
 				}()
 				s.channelMap = nil
+				s.handlers = nil
+				s.wheel = nil
 				s.ReleaseRingBuffer()
 				s.bags = nil
+				s.joins = nil
 				close(s.rejectFuncChan)
-				close(s.unsubscribeChan)
 			})
 			return
 		}
+		if wake != serialReady {
+			atomic.StoreUint32(&s.sleeping, 0)
+			s.wakeups.Inc()
+			if woken && time.Since(parkedAt) < serialShortPark {
+				spinLimit = s.growSpin(spinLimit)
+			} else {
+				spinLimit /= 2
+			}
+			atomic.StoreInt32(&s.spinLimit, int32(spinLimit))
+		}
+		if timeout != nil && !expire.Stop() {
+			select {
+			case <-expire.C:
+			default:
+			}
+		}
+	}
+}
+
+//growSpin 自旋次数上限加倍，不超过SpinCount。
+func (s *Serial) growSpin(spinLimit int) int {
+	if spinLimit >= s.SpinCount {
+		return spinLimit
+	}
+	spinLimit = 2*spinLimit + 1
+	if spinLimit > s.SpinCount {
+		spinLimit = s.SpinCount
 	}
+	return spinLimit
 }
 
-func (s *Serial) assignmentTask() {
+//assignmentTask 处理RingBuffer中的消息，返回是否处理了消息。
+func (s *Serial) assignmentTask() bool {
 	c := &ContextMQ{}
 	c.Node = s.Node
 	data, available := s.ReadFromRingBuffer()
+	worked := available != 0
 	for available != 0 {
 		fs := transport.DecodeByBytes(data)
 		c.Request = fs.GetData()
 		c.ex = fs.GetExtend()
-		globalContextMQHandler[fs.GetFrameType()](c)
+		//已确认的重复投递，再次确认后丢弃。
+		if v := getExtend(c.ex, extendAck); len(v) == 11 && s.duplicate(v) {
+			s.sendAck(v, func(err error) { s.Logger.Error("assignmentTask|", err.Error()) })
+		} else if f, ok := s.handlers[fs.GetFrameType()]; ok {
+			//退订后仍在RingBuffer中的消息丢弃
+			f(c)
+		}
 		s.SetAvailableCursor(available)
 		data, available = s.ReadFromRingBuffer()
 	}
@@ -146,34 +273,88 @@ func (s *Serial) assignmentTask() {
 			}
 		}
 	}
+	return worked
 }
 
 func (s *Serial) serialProcessWrapper(se transport.Session) error {
 	if s.HasWork() {
-		return s.WriteToRingBuffer(se.GetFrameSlice().GetAll())
+		if err := s.WriteToRingBuffer(se.GetFrameSlice().GetAll()); err != nil {
+			return err
+		}
+		//Run协程已休眠或准备休眠时唤醒
+		if atomic.CompareAndSwapUint32(&s.sleeping, 1, 0) {
+			select {
+			case s.wakeChan <- struct{}{}:
+			default:
+			}
+		}
 	}
 	return nil
 }
 
-//Subscribe 订阅频道，需在serial运行前执行（线程不安全）。
+//change 加入订阅变更，由Run协程按顺序执行。
+func (s *Serial) change(f func()) {
+	s.changeMutex.Lock()
+	s.changes = append(s.changes, f)
+	s.changeMutex.Unlock()
+	select {
+	case s.changeSignal <- struct{}{}:
+	default:
+	}
+}
+
+//applyChanges 执行订阅变更，只在Run协程中调用。
+func (s *Serial) applyChanges() {
+	s.changeMutex.Lock()
+	changes := s.changes
+	s.changes = nil
+	s.changeMutex.Unlock()
+	for _, f := range changes {
+		f()
+	}
+}
+
+//Subscribe 订阅频道，运行前后均可调用，由Run协程按调用顺序生效。
 func (s *Serial) Subscribe(channel uint16, f func(*ContextMQ)) {
-	if s.HasWork() {
-		s.Logger.Error("Subscribe|Serial已运行,需在serial运行前执行。")
+	s.change(func() {
+		s.subscribe(channel, f)
+	})
+}
+
+//subscribe 先登记处理函数，再向集群订阅。频道已被本节点的其它Serial或处理函数订阅时记录错误并忽略。
+func (s *Serial) subscribe(channel uint16, f func(*ContextMQ)) {
+	if err := s.Node.claimChannel(channel, s); err != nil {
+		s.Logger.Error("Subscribe|", err.Error(), channel)
+		return
 	}
-	globalContextMQHandler[channel] = f
-	s.Node.sidecar.HandleFunc(channel, s.serialProcessWrapper)
+	s.handlers[channel] = f
 	s.channelMap[channel] = channel
+	s.Node.sidecar.HandleFunc(channel, s.serialProcessWrapper)
 	s.Node.sidecar.SetChannel(uint16(s.Node.sidecar.MachineID), channel, 3)
 }
 
-//SubscribeRace 订阅一组频道,某一频道收到信息后，执行f，需在serial运行前执行（线程不安全）。
-func (s *Serial) SubscribeRace(channels []uint16, f func(*ContextMQ)) {
-	if s.HasWork() {
-		s.Logger.Error("SubscribeRace|Serial已运行,需在serial运行前执行。")
-	}
-	for _, a := range channels {
-		s.Subscribe(a, f)
+//Unsubscribe 退订频道，RingBuffer中尚未处理的该频道消息被丢弃。
+func (s *Serial) Unsubscribe(channel uint16) {
+	s.change(func() {
+		s.unsubscribe(channel)
+	})
+}
+
+func (s *Serial) unsubscribe(channel uint16) {
+	if _, ok := s.channelMap[channel]; ok {
+		s.Node.unsubscribe(channel, s)
 	}
+	delete(s.channelMap, channel)
+	delete(s.handlers, channel)
+}
+
+//SubscribeRace 订阅一组频道,某一频道收到信息后，执行f。
+func (s *Serial) SubscribeRace(channels []uint16, f func(*ContextMQ)) {
+	s.change(func() {
+		for _, a := range channels {
+			s.subscribe(a, f)
+		}
+	})
 }
 
 //ContextMQs 上下文
@@ -181,6 +362,7 @@ type ContextMQs struct {
 	*Node
 	Channels []uint16
 	Requests [][]byte
+	Key      string //SubscribeAllKey汇合的路由键
 }
 
 type bag struct {
@@ -213,40 +395,47 @@ func (bi bagAndIndex) serialProcessWrapper(c *ContextMQ) {
 	}
 }
 
-//SubscribeAll 订阅一组频道,全部频道都收到信息后，执行f，需在serial运行前执行（线程不安全）。
+//SubscribeAll 订阅一组频道,全部频道都收到信息后，执行f，运行前后均可调用。
 func (s *Serial) SubscribeAll(channels []uint16, fs func(*ContextMQs)) {
-	if s.HasWork() {
-		s.Logger.Error("SubscribeAll|Serial已运行,需在serial运行前执行。")
-	}
-	b := &bag{
-		channelsSize: len(channels),
-		channels:     channels,
-		fs:           fs,
-		buf:          make([][]byte, len(channels)),
-	}
-	s.bags = append(s.bags, b)
-	ba := bagAndIndex{}
-	ba.bag = b
-	for i, a := range channels {
-		ba.index = i
-		s.Subscribe(a, ba.serialProcessWrapper)
-	}
+	s.change(func() {
+		b := &bag{
+			channelsSize: len(channels),
+			channels:     channels,
+			fs:           fs,
+			buf:          make([][]byte, len(channels)),
+		}
+		s.bags = append(s.bags, b)
+		ba := bagAndIndex{}
+		ba.bag = b
+		for i, a := range channels {
+			ba.index = i
+			s.subscribe(a, ba.serialProcessWrapper)
+		}
+	})
 }
 
-//UnsubscribeGroup 退订频道
+//UnsubscribeGroup 退订SubscribeRace、SubscribeAll或SubscribeAllKey订阅的一组频道，未凑齐的消息被丢弃。
 func (s *Serial) UnsubscribeGroup(channels []uint16) error {
-	for _, a := range channels {
-		s.Unsubscribe(a)
-	}
-	if !s.HasWork() {
-		return errors.New("UnsubscribeGroup|Serial未运行。")
-	}
 	select {
-	case s.unsubscribeChan <- channels:
-		return nil
-	case <-time.After(64 * s.SnippetDuration):
-		return errors.New("UnsubscribeGroup|退订频道超时。")
+	case <-s.stopChan:
+		return errors.New("UnsubscribeGroup|Serial已关闭。")
+	default:
 	}
+	s.change(func() {
+		l := len(s.bags)
+		for i := 0; i < l; i++ {
+			if util.Uint16Equal(channels, s.bags[i].channels) {
+				copy(s.bags[i:l-1], s.bags[i+1:])
+				s.bags = s.bags[:l-1]
+				break
+			}
+		}
+		s.removeJoin(channels)
+		for _, a := range channels {
+			s.unsubscribe(a)
+		}
+	})
+	return nil
 }
 
 type errAndFunc struct {
@@ -282,3 +471,8 @@ func (s *Serial) Call(channel uint16, data []byte, resolve uint16, reject func(e
 func (s *Serial) Publish(channel uint16, data []byte, reject func(error)) {
 	s.Node.Publish(channel, data, s.serialRejectFuncWrapper(reject))
 }
+
+//Ventilator 开始 pipeline模式
+func (s *Serial) Ventilator(channels []uint16, data []byte, fail uint16, reject func(error)) {
+	s.Node.Ventilator(channels, data, fail, s.serialRejectFuncWrapper(reject))
+}
@@ -0,0 +1,131 @@
+package domi
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+
+	"github.com/duomi520/domi/util"
+)
+
+//JoinConfigure SubscribeAllKey的配置
+type JoinConfigure struct {
+	Timeout    time.Duration     //等待凑齐的时间，默认10秒。
+	MaxPending int               //同时等待凑齐的键数上限，默认4096，超出时最早的键提前过期。
+	Expire     func(*ContextMQs) //过期时以未凑齐的结果调用，未收到的频道为nil，可为nil。
+}
+
+//keyedBag 按路由键汇合的一组频道，只在Run协程中使用。
+type keyedBag struct {
+	JoinConfigure
+	channels []uint16
+	fs       func(*ContextMQs)
+	pending  map[string]*list.Element
+	order    *list.List //按创建顺序，即过期顺序。
+}
+
+//pendingJoin 等待凑齐的键
+type pendingJoin struct {
+	key      string
+	requests [][]byte
+	count    int
+	timerID  uint64
+}
+
+type keyedBagAndIndex struct {
+	*keyedBag
+	s     *Serial
+	index int
+}
+
+//SubscribeAllKey 订阅一组频道，按路由键（NotifyKey、CallKey）汇合，同一键的全部频道都收到信息后，执行fs。
+//在Timeout内未凑齐时调用conf.Expire，同一键在同一频道重复收到时以后到的为准，无路由键的消息以空键汇合。
+func (s *Serial) SubscribeAllKey(channels []uint16, conf JoinConfigure, fs func(*ContextMQs)) {
+	if conf.Timeout <= 0 {
+		conf.Timeout = 10 * time.Second
+	}
+	if conf.MaxPending <= 0 {
+		conf.MaxPending = 4096
+	}
+	s.change(func() {
+		b := &keyedBag{
+			JoinConfigure: conf,
+			channels:      channels,
+			fs:            fs,
+			pending:       make(map[string]*list.Element, 64),
+			order:         list.New(),
+		}
+		s.joins = append(s.joins, b)
+		for i, a := range channels {
+			bi := keyedBagAndIndex{keyedBag: b, s: s, index: i}
+			s.subscribe(a, bi.serialProcessWrapper)
+		}
+	})
+}
+
+//serialProcessWrapper 按键放入对应的位置，凑齐时执行。
+func (bi keyedBagAndIndex) serialProcessWrapper(c *ContextMQ) {
+	key := c.Key()
+	e, ok := bi.pending[key]
+	if !ok {
+		if len(bi.pending) >= bi.MaxPending {
+			bi.expire(bi.s, bi.order.Front())
+		}
+		j := &pendingJoin{
+			key:      key,
+			requests: make([][]byte, len(bi.channels)),
+			timerID:  atomic.AddUint64(&bi.s.timerSequence, 1),
+		}
+		e = bi.order.PushBack(j)
+		bi.pending[key] = e
+		b := bi.keyedBag
+		bi.s.wheel.Add(j.timerID, time.Now().Add(bi.Timeout), func() {
+			if e, ok := b.pending[key]; ok {
+				b.expire(bi.s, e)
+			}
+		})
+	}
+	j := e.Value.(*pendingJoin)
+	if j.requests[bi.index] == nil {
+		j.count++
+	}
+	data := make([]byte, len(c.Request))
+	copy(data, c.Request)
+	j.requests[bi.index] = data
+	if j.count == len(bi.channels) {
+		bi.remove(bi.s, e)
+		bi.fs(&ContextMQs{Node: c.Node, Channels: bi.channels, Requests: j.requests, Key: key})
+	}
+}
+
+//remove 移除等待的键及其定时器
+func (b *keyedBag) remove(s *Serial, e *list.Element) *pendingJoin {
+	j := b.order.Remove(e).(*pendingJoin)
+	delete(b.pending, j.key)
+	s.wheel.Remove(j.timerID)
+	return j
+}
+
+//expire 移除并以未凑齐的结果调用Expire
+func (b *keyedBag) expire(s *Serial, e *list.Element) {
+	j := b.remove(s, e)
+	if b.Expire != nil {
+		b.Expire(&ContextMQs{Node: s.Node, Channels: b.channels, Requests: j.requests, Key: j.key})
+	}
+}
+
+//removeJoin 移除按键汇合的一组频道，未凑齐的消息被丢弃，只在Run协程中调用。
+func (s *Serial) removeJoin(channels []uint16) {
+	l := len(s.joins)
+	for i := 0; i < l; i++ {
+		b := s.joins[i]
+		if util.Uint16Equal(channels, b.channels) {
+			for e := b.order.Front(); e != nil; e = b.order.Front() {
+				b.remove(s, e)
+			}
+			copy(s.joins[i:l-1], s.joins[i+1:])
+			s.joins = s.joins[:l-1]
+			return
+		}
+	}
+}
@@ -1,8 +1,13 @@
-﻿package domi
+package domi
 
 import (
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/duomi520/domi/transport"
 )
 
 func Test_Serial1(t *testing.T) {
@@ -131,6 +136,365 @@ func Test_Serial4(t *testing.T) {
 	})
 }
 
+func testSerialHandler(name string) func(*ContextMQ) {
+	return func(ctx *ContextMQ) {
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, name+":"+string(ctx.Request))
+		testNodeTableMutex.Unlock()
+	}
+}
+
+func Test_SerialMulti(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(560)
+	s1 := &Serial{Node: n2}
+	s1.Init()
+	s2 := &Serial{Node: n2}
+	s2.Init()
+	s3 := &Serial{Node: n1}
+	s3.Init()
+	s1.Subscribe(1501, testSerialHandler("s1"))
+	s2.Subscribe(1502, testSerialHandler("s2"))
+	//不同节点上的serial订阅相同频道，处理函数互不覆盖。
+	s3.Subscribe(1503, testSerialHandler("s3"))
+	s1.Subscribe(1503, testSerialHandler("s1"))
+	go s1.Run()
+	go s2.Run()
+	go s3.Run()
+	time.Sleep(1000 * time.Millisecond)
+	n1.Notify(1501, []byte("1501"), testError)
+	n1.Notify(1502, []byte("1502"), testError)
+	n1.Publish(1503, []byte("1503"), testError)
+	time.Sleep(50 * time.Millisecond)
+	ctxExitFunc()
+	s1.Close()
+	s2.Close()
+	s3.Close()
+	time.Sleep(50 * time.Millisecond)
+	testTableVerificationDisorder(t, []string{
+		"s1:1501",
+		"s2:1502",
+		"s1:1503",
+		"s3:1503",
+	})
+}
+
+func Test_SerialDynamic(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(570)
+	s := &Serial{
+		Node: n2,
+	}
+	s.Init()
+	go s.Run()
+	time.Sleep(1000 * time.Millisecond)
+	//运行中订阅，处理函数中再订阅一组频道。
+	s.Subscribe(1601, func(ctx *ContextMQ) {
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, "open:"+string(ctx.Request))
+		testNodeTableMutex.Unlock()
+		s.SubscribeAll([]uint16{1602, 1603}, testRequestAll)
+	})
+	time.Sleep(500 * time.Millisecond)
+	n1.Notify(1601, []byte("r1"), testError)
+	time.Sleep(500 * time.Millisecond)
+	n1.Notify(1602, []byte("s1602"), testError)
+	n1.Notify(1603, []byte("s1603"), testError)
+	time.Sleep(50 * time.Millisecond)
+	//消息流动中退订
+	n1.Notify(1602, []byte("s1604"), testError)
+	if err := s.UnsubscribeGroup([]uint16{1602, 1603}); err != nil {
+		t.Fatal(err)
+	}
+	s.Unsubscribe(1601)
+	time.Sleep(500 * time.Millisecond)
+	n1.Notify(1601, []byte("r2"), testError)
+	n1.Notify(1602, []byte("s1605"), testError)
+	n1.Notify(1603, []byte("s1606"), testError)
+	time.Sleep(50 * time.Millisecond)
+	//重新订阅同一组频道
+	s.SubscribeAll([]uint16{1602, 1603}, testRequestAll)
+	time.Sleep(500 * time.Millisecond)
+	n1.Notify(1603, []byte("s1608"), testError)
+	n1.Notify(1602, []byte("s1607"), testError)
+	time.Sleep(50 * time.Millisecond)
+	ctxExitFunc()
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	testTableVerification(t, []string{
+		"open:r1",
+		"testRequests: s1602",
+		"testRequests: s1603",
+		"testRequests: s1607",
+		"testRequests: s1608",
+	})
+}
+
+func Test_SerialSameChannel(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(620)
+	s1 := &Serial{
+		Node: n2,
+	}
+	s1.Init()
+	s2 := &Serial{
+		Node: n2,
+	}
+	s2.Init()
+	s1.Subscribe(1701, func(ctx *ContextMQ) {
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, "s1:"+string(ctx.Request))
+		testNodeTableMutex.Unlock()
+	})
+	go s1.Run()
+	time.Sleep(100 * time.Millisecond)
+	//同一节点上的其它Serial及处理函数不能再订阅该频道
+	s2.Subscribe(1701, func(ctx *ContextMQ) {
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, "s2:"+string(ctx.Request))
+		testNodeTableMutex.Unlock()
+	})
+	go s2.Run()
+	time.Sleep(500 * time.Millisecond)
+	n2.Subscribe(1701, testReply)
+	n2.ownerMutex.Lock()
+	owner := n2.owners[1701]
+	n2.ownerMutex.Unlock()
+	if owner != s1 {
+		t.Fatal("频道被其它处理者占用。")
+	}
+	n1.Notify(1701, []byte("r1"), testError)
+	time.Sleep(50 * time.Millisecond)
+	//退订不影响s1的订阅
+	s2.Unsubscribe(1701)
+	n2.Unsubscribe(1701)
+	time.Sleep(500 * time.Millisecond)
+	n1.Notify(1701, []byte("r2"), testError)
+	time.Sleep(50 * time.Millisecond)
+	ctxExitFunc()
+	s1.Close()
+	s2.Close()
+	time.Sleep(50 * time.Millisecond)
+	testTableVerification(t, []string{
+		"s1:r1",
+		"s1:r2",
+	})
+}
+
+func Test_SerialTimer(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(580)
+	s := &Serial{
+		Node: n2,
+	}
+	s.Init()
+	//计数只在Run协程中读写
+	count := 0
+	var every *SerialTimer
+	every = s.Every(30*time.Millisecond, func() {
+		count++
+		testSerialHandler("every")(&ContextMQ{Request: []byte(strconv.Itoa(count))})
+		if count == 3 {
+			every.Stop()
+		}
+	})
+	s.AfterFunc(50*time.Millisecond, func() {
+		testSerialHandler("after")(&ContextMQ{Request: []byte("50ms")})
+	})
+	stopped := s.AfterFunc(60*time.Millisecond, func() {
+		testSerialHandler("after")(&ContextMQ{Request: []byte("60ms")})
+	})
+	if !stopped.Stop() {
+		t.Fatal("Stop应返回true")
+	}
+	if stopped.Stop() {
+		t.Fatal("再次Stop应返回false")
+	}
+	//在处理函数中加入定时器
+	s.Subscribe(1701, func(ctx *ContextMQ) {
+		data := string(ctx.Request)
+		s.AfterFunc(10*time.Millisecond, func() {
+			testSerialHandler("timer")(&ContextMQ{Request: []byte(data)})
+		})
+	})
+	go s.Run()
+	time.Sleep(1000 * time.Millisecond)
+	n1.Notify(1701, []byte("s1701"), testError)
+	time.Sleep(100 * time.Millisecond)
+	ctxExitFunc()
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	if every.Stop() {
+		t.Fatal("已停止的Every再次Stop应返回false")
+	}
+	testTableVerificationDisorder(t, []string{
+		"every:1",
+		"every:2",
+		"every:3",
+		"after:50ms",
+		"timer:s1701",
+	})
+}
+
+func Test_SerialIdle(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(590)
+	s := &Serial{
+		Node: n2,
+	}
+	s.Init()
+	count := 0
+	s.Subscribe(1801, func(ctx *ContextMQ) {
+		count++
+	})
+	//有定时器时休眠至到期，不按精度轮询
+	s.AfterFunc(time.Hour, func() {})
+	every := s.Every(100*time.Millisecond, func() {})
+	go s.Run()
+	time.Sleep(1000 * time.Millisecond)
+	//空闲时休眠，不再轮询
+	w := s.Wakeups()
+	time.Sleep(500 * time.Millisecond)
+	if d := s.Wakeups() - w; d > 15 {
+		t.Fatal("空闲时唤醒次数过多：", d)
+	}
+	every.Stop()
+	//休眠后仍能及时处理消息
+	for i := 0; i < 1000; i++ {
+		n1.Notify(1801, []byte("s1801"), testError)
+		if i%100 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	ctxExitFunc()
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	if count != 1000 {
+		t.Fatal("收到的消息数：", count)
+	}
+}
+
+func Test_SerialSpin(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(630)
+	s := &Serial{
+		Node: n2,
+	}
+	s.Init()
+	s.Subscribe(1802, func(ctx *ContextMQ) {})
+	every := s.Every(5*time.Millisecond, func() {})
+	go s.Run()
+	time.Sleep(1000 * time.Millisecond)
+	//空闲时由定时器唤醒，自旋次数减至0
+	if l := atomic.LoadInt32(&s.spinLimit); l != 0 {
+		t.Fatal("空闲后自旋次数：", l)
+	}
+	every.Stop()
+	//消息密集时自旋次数恢复
+	for i := 0; i < 100; i++ {
+		n1.Notify(1802, []byte("s1802"), testError)
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	l := atomic.LoadInt32(&s.spinLimit)
+	ctxExitFunc()
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	if l < int32(s.SpinCount)/2 {
+		t.Fatal("自旋次数未恢复：", l)
+	}
+}
+
+func Test_SerialReliable(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(640)
+	n1.reliable = newReliableTable(ReliableConfigure{AckTimeout: 200 * time.Millisecond, MaxAttempts: 3})
+	//丢弃第一次确认，模拟确认丢失，消息重新投递到同一Serial。
+	var dropped int32
+	n1.sidecar.HandleFunc(transport.FrameTypeAck, func(se transport.Session) error {
+		if atomic.CompareAndSwapInt32(&dropped, 0, 1) {
+			return nil
+		}
+		return n1.ackWrapper(se)
+	})
+	s := &Serial{
+		Node: n2,
+	}
+	s.Init()
+	count := 0
+	s.Subscribe(1803, func(ctx *ContextMQ) {
+		count++
+		ctx.Ack(testError)
+	})
+	go s.Run()
+	time.Sleep(500 * time.Millisecond)
+	n1.NotifyReliable(1803, []byte("m1"), func(err error) { t.Error(err) })
+	time.Sleep(700 * time.Millisecond)
+	n1.reliable.mutex.Lock()
+	pending := len(n1.reliable.pending)
+	n1.reliable.mutex.Unlock()
+	ctxExitFunc()
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&dropped) != 1 || pending != 0 {
+		t.Fatal("未重新投递：", dropped, pending)
+	}
+	if count != 1 {
+		t.Fatal("重复处理：", count)
+	}
+}
+
+func testJoin(name string) func(*ContextMQs) {
+	return func(ctx *ContextMQs) {
+		data := make([]string, len(ctx.Requests))
+		for i, v := range ctx.Requests {
+			data[i] = string(v)
+		}
+		testNodeTableMutex.Lock()
+		testNodeTable = append(testNodeTable, name+" "+ctx.Key+":"+strings.Join(data, ","))
+		testNodeTableMutex.Unlock()
+	}
+}
+
+func Test_SerialJoin(t *testing.T) {
+	ctxExitFunc, n1, n2 := test2Node(610)
+	s := &Serial{
+		Node: n2,
+	}
+	s.Init()
+	s.SubscribeAllKey([]uint16{1901, 1902}, JoinConfigure{
+		Timeout:    200 * time.Millisecond,
+		MaxPending: 2,
+		Expire:     testJoin("expire"),
+	}, testJoin("join"))
+	go s.Run()
+	time.Sleep(1000 * time.Millisecond)
+	//按键汇合，不按到达顺序
+	n1.NotifyKey(1901, "a", []byte("a1"), testError)
+	n1.NotifyKey(1902, "b", []byte("b2"), testError)
+	n1.NotifyKey(1902, "a", []byte("a2"), testError)
+	time.Sleep(50 * time.Millisecond)
+	//b超时
+	time.Sleep(300 * time.Millisecond)
+	//超出上限时最早的c提前过期
+	n1.NotifyKey(1901, "c", []byte("c1"), testError)
+	n1.NotifyKey(1901, "d", []byte("d1"), testError)
+	n1.NotifyKey(1901, "e", []byte("e1"), testError)
+	time.Sleep(50 * time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	//退订时丢弃未凑齐的键
+	n1.NotifyKey(1901, "f", []byte("f1"), testError)
+	time.Sleep(50 * time.Millisecond)
+	if err := s.UnsubscribeGroup([]uint16{1901, 1902}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	ctxExitFunc()
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	testTableVerification(t, []string{
+		"join a:a1,a2",
+		"expire b:,b2",
+		"expire c:c1,",
+		"expire d:d1,",
+		"expire e:e1,",
+	})
+}
+
 func Test_RejectFunc1(t *testing.T) {
 	ctxExitFunc, n1, _ := test2Node(550)
 	s := &Serial{
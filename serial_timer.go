@@ -0,0 +1,67 @@
+package domi
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//SerialTimer Serial的定时器，回调在Run协程中执行。
+type SerialTimer struct {
+	s     *Serial
+	id    uint64
+	state uint32 //0 等待，1 已触发或已停止
+}
+
+//Stop 停止定时器，返回true表示阻止了回调（Every为阻止了后续的回调），可在回调中调用。
+func (t *SerialTimer) Stop() bool {
+	if !atomic.CompareAndSwapUint32(&t.state, 0, 1) {
+		return false
+	}
+	t.s.change(func() {
+		t.s.wheel.Remove(t.id)
+	})
+	return true
+}
+
+//AfterFunc 经过d后在Run协程中调用f，可在任意协程中调用。
+func (s *Serial) AfterFunc(d time.Duration, f func()) *SerialTimer {
+	t := &SerialTimer{s: s, id: atomic.AddUint64(&s.timerSequence, 1)}
+	at := time.Now().Add(d)
+	s.change(func() {
+		s.wheel.Add(t.id, at, func() {
+			if atomic.CompareAndSwapUint32(&t.state, 0, 1) {
+				f()
+			}
+		})
+	})
+	return t
+}
+
+//Every 每隔d在Run协程中调用f，直至Stop，d小于TimerTick时按TimerTick。
+//回调耽误的周期被跳过，不补调。
+func (s *Serial) Every(d time.Duration, f func()) *SerialTimer {
+	if d < s.TimerTick {
+		d = s.TimerTick
+	}
+	t := &SerialTimer{s: s, id: atomic.AddUint64(&s.timerSequence, 1)}
+	at := time.Now().Add(d)
+	var fire func()
+	fire = func() {
+		if atomic.LoadUint32(&t.state) != 0 {
+			return
+		}
+		f()
+		if atomic.LoadUint32(&t.state) != 0 {
+			return
+		}
+		at = at.Add(d)
+		if now := time.Now(); at.Before(now) {
+			at = now.Add(d)
+		}
+		s.wheel.Add(t.id, at, fire)
+	}
+	s.change(func() {
+		s.wheel.Add(t.id, at, fire)
+	})
+	return t
+}
@@ -0,0 +1,316 @@
+package sidecar
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//AdminSignatureWindow 签名时间戳的有效范围
+var AdminSignatureWindow = 30 * time.Second
+
+//定义关闭节点的请求头
+const (
+	AdminHeaderTimestamp = "X-Domi-Timestamp" //unix秒
+	AdminHeaderSignature = "X-Domi-Signature" //hex(HMAC-SHA256(Secret, 方法\n路径\n时间戳))
+)
+
+//AdminConfigure 管理接口配置，nil或未设置Token、Secret时禁止通过http关闭节点。
+type AdminConfigure struct {
+	Token        string   //令牌，请求头 Authorization: Bearer <Token>
+	Secret       []byte   //HMAC-SHA256签名密钥，见SignAdminRequest
+	AllowIPs     []string //允许的来源ip，空时不限制
+	Address      string   //独立的管理监听地址，如":7300"，空时与HTTP端口共用
+	AuditLogPath string   //审计日志目录，空时输出到标准输出
+}
+
+//SignAdminRequest 以Secret签名关闭节点的请求
+func SignAdminRequest(r *http.Request, secret []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(AdminHeaderTimestamp, ts)
+	r.Header.Set(AdminHeaderSignature, adminSignature(secret, r.Method, r.URL.Path, ts))
+}
+
+func adminSignature(secret []byte, method, path, ts string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//handleExit 注册关闭节点的接口，配置了Address时注册在独立的管理监听上。
+func (s *Sidecar) handleExit(pre string) error {
+	path := ""
+	if s.admin != nil {
+		path = s.admin.AuditLogPath
+	}
+	var err error
+	s.audit, err = util.NewLogger(util.InfoLevel, path)
+	if err != nil {
+		return errors.New("handleExit|审计日志创建失败：" + err.Error())
+	}
+	s.audit.SetMark(fmt.Sprintf("Audit.%d", s.MachineID))
+	if s.admin != nil && s.admin.Address != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc(pre+"/exit", s.exit)
+		s.adminServer = &http.Server{
+			Addr:           s.admin.Address,
+			Handler:        mux,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: 1 << 20,
+		}
+		return nil
+	}
+	http.HandleFunc(pre+"/exit", s.exit)
+	return nil
+}
+
+//exit 退出，需POST并通过来源地址、令牌或签名校验，每次请求均记录审计日志。
+func (s *Sidecar) exit(w http.ResponseWriter, r *http.Request) {
+	code, err := s.authorizeExit(r)
+	if err != nil {
+		s.audit.Warn(fmt.Sprintf("exit|拒绝 来源:%s 方法:%s 原因:%s", r.RemoteAddr, r.Method, err.Error()))
+		http.Error(w, err.Error(), code)
+		return
+	}
+	s.audit.Info(fmt.Sprintf("exit|接受 来源:%s", r.RemoteAddr))
+	fmt.Fprintln(w, "exit")
+	s.doOnce.Do(func() {
+		s.exitFunc()
+	})
+}
+
+//authorizeExit 校验关闭节点的请求，失败时返回http状态码。
+func (s *Sidecar) authorizeExit(r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("只允许POST")
+	}
+	ac := s.admin
+	if ac == nil || (ac.Token == "" && len(ac.Secret) == 0) {
+		return http.StatusForbidden, errors.New("未配置令牌或签名密钥")
+	}
+	if len(ac.AllowIPs) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		allowed := false
+		for _, ip := range ac.AllowIPs {
+			if ip == host {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return http.StatusForbidden, errors.New("来源地址不在允许列表")
+		}
+	}
+	if ac.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(ac.Token)) == 1 {
+			return http.StatusOK, nil
+		}
+	}
+	if len(ac.Secret) > 0 {
+		ts := r.Header.Get(AdminHeaderTimestamp)
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err == nil {
+			d := time.Since(time.Unix(sec, 0))
+			if d < AdminSignatureWindow && d > -AdminSignatureWindow {
+				sign := adminSignature(ac.Secret, r.Method, r.URL.Path, ts)
+				if hmac.Equal([]byte(sign), []byte(r.Header.Get(AdminHeaderSignature))) {
+					return http.StatusOK, nil
+				}
+			}
+		}
+	}
+	return http.StatusUnauthorized, errors.New("令牌或签名无效")
+}
+
+//NodeStatus 节点信息及状态
+type NodeStatus struct {
+	Info
+	State string
+}
+
+//ChannelStatus 频道及订阅的机器id
+type ChannelStatus struct {
+	Channel    uint16
+	MachineIDs []uint16
+	Groups     map[string][]uint16 `json:",omitempty"` //消费组
+}
+
+//SessionStatus 会话状态
+type SessionStatus struct {
+	MachineID      uint16
+	RemoteAddr     string
+	State          string
+	CircuitBreaker string
+	Outstanding    int64 //未完成的请求数
+}
+
+//Stats 本节点的运行统计
+type Stats struct {
+	MachineID       int
+	State           string
+	LimiterEnabled  bool
+	LimiterTokens   int64 //限流器当前令牌数
+	LimitRate       int64
+	LimitSize       int64
+	DispatcherQueue int //调度者等待分配的任务数
+}
+
+//stateName 状态名
+func stateName(s uint32) string {
+	switch s {
+	case util.StateDie:
+		return "die"
+	case util.StateWork:
+		return "work"
+	case util.StatePause:
+		return "pause"
+	case util.StateCircuitBreakerClosed:
+		return "closed"
+	case util.StateCircuitBreakerOpen:
+		return "open"
+	case util.StateCircuitBreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//handleAdmin 注册只读的管理接口
+func (s *Sidecar) handleAdmin(pre string) {
+	http.HandleFunc(pre+"/nodes", s.adminGet(s.adminNodes))
+	http.HandleFunc(pre+"/channels", s.adminGet(s.adminChannels))
+	http.HandleFunc(pre+"/subscriptions", s.adminGet(s.adminSubscriptions))
+	http.HandleFunc(pre+"/sessions", s.adminGet(s.adminSessions))
+	http.HandleFunc(pre+"/stats", s.adminGet(s.adminStats))
+}
+
+//adminGet 只接受GET，结果编码为json。
+func (s *Sidecar) adminGet(f func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := f()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			s.Logger.Error("adminGet|", err.Error())
+		}
+	}
+}
+
+//adminNodes 注册中心内的节点
+func (s *Sidecar) adminNodes() (interface{}, error) {
+	nodes, err := s.GetKey(context.TODO(), "machine/")
+	if err != nil {
+		return nil, err
+	}
+	states, err := s.GetKey(context.TODO(), "state/")
+	if err != nil {
+		return nil, err
+	}
+	sm := make(map[int]string, len(states))
+	for _, v := range states {
+		if len(v) >= 6 {
+			m := bytesTOStateMsg(v)
+			sm[int(m.id)] = stateName(m.state)
+		}
+	}
+	ns := make([]NodeStatus, 0, len(nodes))
+	for _, v := range nodes {
+		n := NodeStatus{}
+		if err := json.Unmarshal(v, &n.Info); err != nil {
+			return nil, err
+		}
+		n.State = sm[n.MachineID]
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+//adminChannels 频道表
+func (s *Sidecar) adminChannels() (interface{}, error) {
+	cs := make([]ChannelStatus, 0, 64)
+	for i := range s.channels {
+		b := (*bucket)(atomic.LoadPointer(&s.channels[i]))
+		if b != nil {
+			status := ChannelStatus{Channel: uint16(i), MachineIDs: b.sets}
+			if len(b.groups) > 0 {
+				status.Groups = make(map[string][]uint16, len(b.groups))
+				for _, g := range b.groups {
+					status.Groups[g.name] = g.sets
+				}
+			}
+			cs = append(cs, status)
+		}
+	}
+	return cs, nil
+}
+
+//adminSubscriptions 本节点订阅的频道
+func (s *Sidecar) adminSubscriptions() (interface{}, error) {
+	cs := make([]uint16, 0, 64)
+	for i := range s.channels {
+		b := (*bucket)(atomic.LoadPointer(&s.channels[i]))
+		if b != nil && containsUint16(b.sets, s.machineID) {
+			cs = append(cs, uint16(i))
+		}
+	}
+	return cs, nil
+}
+
+//adminSessions 与其它节点的会话
+func (s *Sidecar) adminSessions() (interface{}, error) {
+	ss := make([]SessionStatus, 0, 16)
+	for i := range s.sessions {
+		m := (*transport.SessionTCP)(atomic.LoadPointer(&s.sessions[i]))
+		if m != nil {
+			ss = append(ss, SessionStatus{
+				MachineID:      uint16(i),
+				RemoteAddr:     m.Conn.RemoteAddr().String(),
+				State:          stateName(m.GetState()),
+				CircuitBreaker: stateName(m.GetCircuitBreakerState()),
+				Outstanding:    s.Outstanding(uint16(i)),
+			})
+		}
+	}
+	return ss, nil
+}
+
+//adminStats 限流器、调度者统计
+func (s *Sidecar) adminStats() (interface{}, error) {
+	st := Stats{
+		MachineID:       s.MachineID,
+		State:           stateName(s.GetState()),
+		DispatcherQueue: s.dispatcher.Len(),
+	}
+	if s.limiter != nil {
+		st.LimiterEnabled = true
+		st.LimiterTokens = s.limiter.Tokens()
+		st.LimitRate = s.limiter.LimitRate
+		st.LimitSize = s.limiter.LimitSize
+	}
+	return st, nil
+}
@@ -0,0 +1,143 @@
+package sidecar
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+//Balancer 负载均衡策略，从订阅频道的节点中选出一个，load返回节点未完成的请求数。
+//sets 为只读，不可修改。
+type Balancer interface {
+	Pick(sets []uint16, load func(uint16) int64) uint16
+}
+
+//SetBalancer 设置频道的负载均衡策略，nil时为轮询。
+func (c *cluster) SetBalancer(channel uint16, b Balancer) {
+	if b == nil {
+		atomic.StorePointer(&c.balancers[channel], nil)
+		return
+	}
+	atomic.StorePointer(&c.balancers[channel], unsafe.Pointer(&b))
+}
+
+//getBalancer 取得频道的负载均衡策略
+func (c *cluster) getBalancer(channel uint16) Balancer {
+	p := atomic.LoadPointer(&c.balancers[channel])
+	if p == nil {
+		return nil
+	}
+	return *(*Balancer)(p)
+}
+
+//AddOutstanding 修改节点未完成的请求数
+func (c *cluster) AddOutstanding(id uint16, delta int64) {
+	atomic.AddInt64(&c.outstanding[id], delta)
+}
+
+//Outstanding 节点未完成的请求数
+func (c *cluster) Outstanding(id uint16) int64 {
+	return atomic.LoadInt64(&c.outstanding[id])
+}
+
+//RandomBalancer 随机
+type RandomBalancer struct{}
+
+//Pick 选择
+func (RandomBalancer) Pick(sets []uint16, load func(uint16) int64) uint16 {
+	return sets[rand.Intn(len(sets))]
+}
+
+//LeastOutstandingBalancer 选择未完成请求数最少的节点，相同时从随机位置开始取第一个。
+type LeastOutstandingBalancer struct{}
+
+//Pick 选择
+func (LeastOutstandingBalancer) Pick(sets []uint16, load func(uint16) int64) uint16 {
+	l := len(sets)
+	start := rand.Intn(l)
+	id := sets[start]
+	min := load(id)
+	for i := 1; i < l && min > 0; i++ {
+		v := sets[(start+i)%l]
+		if n := load(v); n < min {
+			id, min = v, n
+		}
+	}
+	return id
+}
+
+//PowerOfTwoBalancer 随机选出两个节点，取未完成请求数较少的一个。
+type PowerOfTwoBalancer struct{}
+
+//Pick 选择
+func (PowerOfTwoBalancer) Pick(sets []uint16, load func(uint16) int64) uint16 {
+	l := len(sets)
+	if l == 1 {
+		return sets[0]
+	}
+	i := rand.Intn(l)
+	j := rand.Intn(l - 1)
+	if j >= i {
+		j++
+	}
+	if load(sets[j]) < load(sets[i]) {
+		return sets[j]
+	}
+	return sets[i]
+}
+
+//WeightedRoundRobinBalancer 平滑加权轮询，未设置权重的节点权重为1。
+type WeightedRoundRobinBalancer struct {
+	mutex   sync.Mutex
+	weights map[uint16]int
+	current map[uint16]int
+}
+
+//NewWeightedRoundRobinBalancer 新建 weights 机器id对应的权重
+func NewWeightedRoundRobinBalancer(weights map[uint16]int) *WeightedRoundRobinBalancer {
+	w := &WeightedRoundRobinBalancer{
+		weights: make(map[uint16]int, len(weights)),
+		current: make(map[uint16]int, len(weights)),
+	}
+	for k, v := range weights {
+		w.weights[k] = v
+	}
+	return w
+}
+
+//SetWeight 设置节点权重
+func (w *WeightedRoundRobinBalancer) SetWeight(id uint16, weight int) {
+	w.mutex.Lock()
+	w.weights[id] = weight
+	w.mutex.Unlock()
+}
+
+//Pick 选择
+func (w *WeightedRoundRobinBalancer) Pick(sets []uint16, load func(uint16) int64) uint16 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	total := 0
+	best := sets[0]
+	found := false
+	for _, id := range sets {
+		weight, ok := w.weights[id]
+		if !ok {
+			weight = 1
+		}
+		if weight <= 0 {
+			continue
+		}
+		total += weight
+		w.current[id] += weight
+		if !found || w.current[id] > w.current[best] {
+			best = id
+			found = true
+		}
+	}
+	//全部权重为0时退化为第一个
+	if found {
+		w.current[best] -= total
+	}
+	return best
+}
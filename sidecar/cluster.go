@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -23,51 +24,112 @@ func (c *cluster) Specify(id, channel uint16, fs transport.FrameSlice, errFunc f
 	errFunc(errors.New("Specify|请求失败！"))
 }
 
-//AskOne 请求某一个
-func (c *cluster) AskOne(channel uint16, fs transport.FrameSlice, errFunc func(error)) {
+//AskOne 请求某一个，按频道的负载均衡策略选择节点，失败时轮询其它节点。返回发送的机器id，失败时返回-1。
+func (c *cluster) AskOne(channel uint16, fs transport.FrameSlice, errFunc func(error)) int {
 	b := (*bucket)(atomic.LoadPointer(&c.channels[channel]))
 	if b != nil {
+		var count uint32
+		var id uint16
+		var l uint32
+		if bl := c.getBalancer(channel); bl != nil {
+			id, l = bl.Pick(b.sets, c.Outstanding), uint32(len(b.sets))
+		} else {
+			id, l = b.next()
+		}
 		for {
-			var count uint32
-			id, l := b.next()
 			m := (*transport.SessionTCP)(atomic.LoadPointer(&c.sessions[id]))
 			if m != nil {
 				if err := m.WriteFrameDataToCache(fs, errFunc); err == nil {
-					return
+					return int(id)
 				}
 			}
 			count++
 			if count > l {
 				errFunc(fmt.Errorf("AskOne|bucket.sets未发现 %d,id=%d,l=%d", channel, id, l))
-				return
+				return -1
 			}
+			id, l = b.next()
 		}
 	}
 	errFunc(fmt.Errorf("AskOne|bucket 未发现频道 %d", channel))
+	return -1
 }
 
-//AskAll 请求所有
-func (c *cluster) AskAll(channel uint16, fs transport.FrameSlice, errFunc func(error)) {
+//AskOther 请求exclude以外的某一个，全部被排除时不再排除。返回发送的机器id，失败时返回-1。
+func (c *cluster) AskOther(channel uint16, exclude []uint16, fs transport.FrameSlice, errFunc func(error)) int {
+	b := (*bucket)(atomic.LoadPointer(&c.channels[channel]))
+	if b == nil {
+		errFunc(fmt.Errorf("AskOther|bucket 未发现频道 %d", channel))
+		return -1
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < len(b.sets); i++ {
+			id, _ := b.next()
+			if round == 0 && containsUint16(exclude, id) {
+				continue
+			}
+			m := (*transport.SessionTCP)(atomic.LoadPointer(&c.sessions[id]))
+			if m != nil {
+				if err := m.WriteFrameDataToCache(fs, errFunc); err == nil {
+					return int(id)
+				}
+			}
+		}
+	}
+	errFunc(fmt.Errorf("AskOther|没有可用的节点 %d", channel))
+	return -1
+}
+
+//AskAll 请求所有，消费组内只请求其中一个，返回尝试发送的节点数，发送失败的节点均调用errFunc。
+func (c *cluster) AskAll(channel uint16, fs transport.FrameSlice, errFunc func(error)) int {
+	return c.AskAllEach(channel, fs, func(int) func(error) { return errFunc })
+}
+
+//AskAllEach 同AskAll，errFor为每个接收目标（节点或消费组）生成失败回调，目标按发送顺序从0编号，
+//未发现频道时目标为-1。同一目标的失败回调可能调用多次。
+func (c *cluster) AskAllEach(channel uint16, fs transport.FrameSlice, errFor func(target int) func(error)) int {
 	b := (*bucket)(atomic.LoadPointer(&c.channels[channel]))
 	if b != nil {
+		count := 0
 		l := len(b.sets)
 		for i := 0; i < l; i++ {
 			id := b.sets[i]
+			if _, ok := b.groupOf[id]; ok {
+				continue
+			}
 			m := (*transport.SessionTCP)(atomic.LoadPointer(&c.sessions[id]))
 			if m != nil {
+				errFunc := errFor(count)
+				count++
 				if err := m.WriteFrameDataToCache(fs, errFunc); err != nil {
 					errFunc(err)
 				}
 			}
 		}
-		return
+		//每个消费组一份
+		for _, g := range b.groups {
+			errFunc := errFor(count)
+			count++
+			if !c.askGroup(g, fs, errFunc) {
+				errFunc(fmt.Errorf("AskAll|消费组没有可用的节点 %d %s", channel, g.name))
+			}
+		}
+		return count
 	}
-	errFunc(fmt.Errorf("AskAll|bucket 未发现频道 %d", channel))
+	errFor(-1)(fmt.Errorf("AskAll|bucket 未发现频道 %d", channel))
+	return 0
 }
 
 type cluster struct {
-	sessions [1024]unsafe.Pointer  //*sessions	原子操作
-	channels [65536]unsafe.Pointer //*bucket	原子操作
+	sessions    [1024]unsafe.Pointer  //*sessions	原子操作
+	channels    [65536]unsafe.Pointer //*bucket	原子操作
+	balancers   [65536]unsafe.Pointer //*Balancer	原子操作
+	outstanding [1024]int64           //各节点未完成的请求数	原子操作
+	topics      *topicTrie            //集群中各节点订阅的主题
+
+	watchMutex  sync.Mutex
+	peerLost    []func(id uint16)          //节点失联的回调
+	channelLeft []func(id, channel uint16) //节点退订频道的回调
 
 	machineID uint16
 
@@ -82,6 +144,7 @@ func newCluster(name, HTTPPort, TCPPort string, operation interface{}, logger *u
 	var err error
 	c := &cluster{
 		readyChan: make(chan struct{}),
+		topics:    newTopicTrie(),
 		Logger:    logger,
 	}
 	c.Peer, err = newPeer(name, HTTPPort, TCPPort, operation)
@@ -124,29 +187,31 @@ func (c *cluster) Run() {
 				v := (*bucket)(atomic.LoadPointer(&c.channels[cc.channel]))
 				nb := newBucket()
 				if v == nil {
-					nb.sets = append(nb.sets, cc.id)
-					nb.cursorAndLenght = setCursorAndLenght(0, 1)
+					nb.add(nil, cc.id)
 				} else {
 					nb.add(v.sets, cc.id)
 				}
+				nb.setGroups(v, cc.id, cc.group)
 				atomic.StorePointer(&c.channels[cc.channel], unsafe.Pointer(nb))
 			case 2: //频道删除
 				v := (*bucket)(atomic.LoadPointer(&c.channels[cc.channel]))
 				if v != nil {
 					nb := newBucket()
 					nb.remove(v.sets, cc.id)
+					nb.setGroups(v, cc.id, "")
 					if nb.cursorAndLenght != 0 {
 						atomic.StorePointer(&c.channels[cc.channel], unsafe.Pointer(nb))
 					} else {
 						atomic.StorePointer(&c.channels[cc.channel], nil)
 					}
 				}
+				c.emitChannelLeft(cc.id, cc.channel)
 			case 3: //PUT
 				util.CopyUint16(channelValue[:2], cc.id)
 				util.CopyUint16(channelValue[2:4], cc.channel)
 				copy(channelKey[lenChannelKey-5:lenChannelKey-3], channelValue[2:4])
 				copy(channelKey[lenChannelKey-2:], channelValue[:2])
-				if err = c.PutKey(context.TODO(), string(channelKey), string(channelValue)); err != nil {
+				if err = c.PutKey(context.TODO(), string(channelKey), string(channelValue)+cc.group); err != nil {
 					c.Logger.Error("Run|", err.Error())
 				}
 
@@ -159,6 +224,16 @@ func (c *cluster) Run() {
 					c.Logger.Error("Run|", err.Error())
 				}
 			}
+		//主题
+		case tm := <-c.TopicChan:
+			switch tm.operation {
+			case 1:
+				c.topics.add(tm.topic, tm.id)
+			case 2:
+				c.topics.remove(tm.topic, tm.id)
+			case 3, 4:
+				c.putTopic(tm)
+			}
 		//状态
 		case sc := <-c.StateChan:
 			switch sc.operation {
@@ -196,6 +271,7 @@ func (c *cluster) Run() {
 					atomic.StorePointer(&c.sessions[nc.id], nil)
 					((*transport.SessionTCP)(m)).SetState(util.StateDie)
 				}
+				c.emitPeerLost(nc.id)
 			case 3: //连接
 				atomic.StorePointer(&c.sessions[nc.id], unsafe.Pointer(nc.ss))
 			}
@@ -211,37 +287,26 @@ func (c *cluster) initStateAndChannels() error {
 	}
 	temp := make(map[uint16]*bucket, 128)
 	for i := 0; i < len(cl); i++ {
-		id := util.BytesToUint16(cl[i][:2])
-		channel := util.BytesToUint16(cl[i][2:])
-		v, ok := temp[channel]
+		cm := valueTOChannelMsg(cl[i])
+		v, ok := temp[cm.channel]
+		nb := newBucket()
 		if ok {
-			v.sets = append(v.sets, id)
-			v.cursorAndLenght = setCursorAndLenght(0, uint32(len(v.sets)))
+			nb.add(v.sets, cm.id)
 		} else {
-			nb := newBucket()
-			nb.sets = append(nb.sets, id)
-			nb.cursorAndLenght = setCursorAndLenght(0, 1)
-			temp[channel] = nb
+			nb.add(nil, cm.id)
 		}
+		nb.setGroups(v, cm.id, cm.group)
+		temp[cm.channel] = nb
 	}
-	for {
-		select {
-		case <-c.StateChan:
-			return errors.New("initStateAndChannels|StateChan 检测到不同步。")
-		default:
-			goto end1
-		}
+	tl, err := c.GetKey(context.TODO(), topicPrefix)
+	if err != nil {
+		return err
 	}
-end1:
-	for {
-		select {
-		case <-c.ChannelChan:
-			return errors.New("initStateAndChannels|ChannelChan 检测到不同步。")
-		default:
-			goto end2
-		}
+	for _, v := range tl {
+		tm := valueTOTopicMsg(v)
+		c.topics.add(tm.topic, tm.id)
 	}
-end2:
+	//watch先于GetKey建立，快照之后排队的事件由Run按序重放，bucket的增删为幂等操作。
 	for key, value := range temp {
 		c.channels[key] = unsafe.Pointer(value)
 	}
@@ -253,7 +318,7 @@ end2:
 编码
 key: "machine/xx"	xx 2字节机器id
 key: "state/xx"		xx 2字节机器id						值： 2字节机器id、4字节状态
-key: "channel/xx/xx",xx/xx 2字节频道/2字节机器id		值： 2字节机器id、2字节频道
+key: "channel/xx/xx",xx/xx 2字节频道/2字节机器id		值： 2字节机器id、2字节频道、消费组（可无）
 */
 
 type stateMsg struct {
@@ -294,6 +359,7 @@ func getNodeID(b []byte) uint16 {
 
 type channelMsg struct {
 	id, channel, operation uint16
+	group                  string //消费组，空为不属于任何组
 }
 
 func keyTOChannelMsg(b []byte) channelMsg {
@@ -308,6 +374,7 @@ func valueTOChannelMsg(b []byte) channelMsg {
 	var cm channelMsg
 	cm.id = util.BytesToUint16(b[:2])
 	cm.channel = util.BytesToUint16(b[2:4])
+	cm.group = string(b[4:])
 	return cm
 }
 
@@ -323,6 +390,9 @@ func (c *cluster) SetChannel(id, channel, operation uint16) {
 type bucket struct {
 	cursorAndLenght uint64
 	sets            []uint16
+	ring            []ringNode        //一致性哈希环，只读
+	groupOf         map[uint16]string //机器id -> 消费组，只读
+	groups          []*consumerGroup
 }
 
 func setCursorAndLenght(cursor, lenght uint32) uint64 {
@@ -343,8 +413,16 @@ func newBucket() *bucket {
 
 func (b *bucket) add(base []uint16, id uint16) {
 	b.sets = append(b.sets, base...)
+	for _, v := range b.sets {
+		if v == id {
+			b.cursorAndLenght = setCursorAndLenght(0, uint32(len(b.sets)))
+			b.buildRing()
+			return
+		}
+	}
 	b.sets = append(b.sets, id)
 	b.cursorAndLenght = setCursorAndLenght(0, uint32(len(b.sets)))
+	b.buildRing()
 }
 
 //TODO 优化性能
@@ -361,6 +439,7 @@ func (b *bucket) remove(base []uint16, id uint16) {
 		}
 	}
 	b.cursorAndLenght = setCursorAndLenght(0, uint32(len(b.sets)))
+	b.buildRing()
 }
 
 func (b *bucket) next() (uint16, uint32) {
@@ -20,9 +20,9 @@ type etcd struct {
 	Client  *clientv3.Client
 	leaseID clientv3.LeaseID
 
-	NodePrefix, StatePrefix, ChannelPrefix          string
-	NodeWatchChan, StateWatchChan, ChannelWatchChan clientv3.WatchChan
-	distributerChan
+	NodePrefix, StatePrefix, ChannelPrefix, TopicPrefix             string
+	NodeWatchChan, StateWatchChan, ChannelWatchChan, TopicWatchChan clientv3.WatchChan
+	eventChan                                                       chan Event
 
 	Endpoints   []string
 	initAddress []Info
@@ -92,12 +92,11 @@ func (e *etcd) RegisterServer(info Info, endpoints interface{}) (int64, int, err
 		return -1, -1, errors.New("registerServer|保持健康检查失败: " + err.Error())
 	}
 	bSuccess = true
-	e.NodeChan = make(chan nodeMsg, 128)
-	e.StateChan = make(chan stateMsg, 128)
-	e.ChannelChan = make(chan channelMsg, 128)
+	e.eventChan = make(chan Event, 128)
 	e.NodeWatchChan = e.Client.Watch(context.TODO(), e.NodePrefix, clientv3.WithPrefix())
 	e.StateWatchChan = e.Client.Watch(context.TODO(), e.StatePrefix, clientv3.WithPrefix())
 	e.ChannelWatchChan = e.Client.Watch(context.TODO(), e.ChannelPrefix, clientv3.WithPrefix())
+	e.TopicWatchChan = e.Client.Watch(context.TODO(), e.TopicPrefix, clientv3.WithPrefix())
 	go e.run()
 	return e.initAddress[0].ID, e.initAddress[0].MachineID, nil
 }
@@ -115,47 +114,33 @@ func (e *etcd) DisconDistributer() error {
 }
 
 func (e *etcd) run() {
+	defer close(e.eventChan)
 	for {
+		var wr clientv3.WatchResponse
 		select {
-		case nw := <-e.NodeWatchChan:
-			for _, ev := range nw.Events {
-				switch ev.Type {
-				case clientv3.EventTypeDelete:
-					var nc nodeMsg
-					nc.operation = 2
-					nc.id = getNodeID(ev.Kv.Key)
-					e.NodeChan <- nc
-				}
-			}
-		case sw := <-e.StateWatchChan:
-			for _, ev := range sw.Events {
-				switch ev.Type {
-				case clientv3.EventTypePut:
-					sm := bytesTOStateMsg(ev.Kv.Value)
-					sm.operation = 1
-					e.StateChan <- sm
-				}
-			}
-		case cw := <-e.ChannelWatchChan:
-			for _, ev := range cw.Events {
-				switch ev.Type {
-				case clientv3.EventTypePut:
-					cm := valueTOChannelMsg(ev.Kv.Value)
-					cm.operation = 1
-					e.ChannelChan <- cm
-				case clientv3.EventTypeDelete:
-					cm := keyTOChannelMsg(ev.Kv.Key)
-					cm.operation = 2
-					e.ChannelChan <- cm
-
-				}
-			}
+		case wr = <-e.NodeWatchChan:
+		case wr = <-e.StateWatchChan:
+		case wr = <-e.ChannelWatchChan:
+		case wr = <-e.TopicWatchChan:
 		case <-e.stopChan:
 			return
 		}
+		for _, ev := range wr.Events {
+			event := Event{Put: ev.Type == clientv3.EventTypePut, Key: ev.Kv.Key, Value: ev.Kv.Value}
+			select {
+			case e.eventChan <- event:
+			case <-e.stopChan:
+				return
+			}
+		}
 	}
 }
 
+//Events 键值变化事件
+func (e *etcd) Events() <-chan Event {
+	return e.eventChan
+}
+
 //getMachineID 分配机器id
 func (e *etcd) getMachineID(cli *clientv3.Client) (int, error) {
 	l := len(e.NodePrefix)
@@ -0,0 +1,69 @@
+package sidecar
+
+import (
+	"sync/atomic"
+
+	"github.com/duomi520/domi/transport"
+)
+
+//consumerGroup 消费组，组内轮询。
+type consumerGroup struct {
+	name   string
+	sets   []uint16
+	cursor uint32 //原子操作
+}
+
+//SetGroupChannel 以消费组订阅频道，同一组内的节点竞争消费，不同组各收到一份。
+func (c *cluster) SetGroupChannel(id, channel uint16, group string) {
+	var cm channelMsg
+	cm.id = id
+	cm.channel = channel
+	cm.group = group
+	cm.operation = 3
+	c.ChannelChan <- cm
+}
+
+//setGroups 复制base的消费组并设置id的消费组，group为空时不属于任何组，需在add、remove之后调用。
+func (b *bucket) setGroups(base *bucket, id uint16, group string) {
+	b.groupOf = make(map[uint16]string, 8)
+	if base != nil {
+		for k, v := range base.groupOf {
+			b.groupOf[k] = v
+		}
+	}
+	if group == "" {
+		delete(b.groupOf, id)
+	} else {
+		b.groupOf[id] = group
+	}
+	b.groups = nil
+	index := make(map[string]*consumerGroup, len(b.groupOf))
+	for _, v := range b.sets {
+		name, ok := b.groupOf[v]
+		if !ok {
+			continue
+		}
+		g, ok := index[name]
+		if !ok {
+			g = &consumerGroup{name: name}
+			index[name] = g
+			b.groups = append(b.groups, g)
+		}
+		g.sets = append(g.sets, v)
+	}
+}
+
+//askGroup 组内轮询，失败时尝试组内其它节点。
+func (c *cluster) askGroup(g *consumerGroup, fs transport.FrameSlice, errFunc func(error)) bool {
+	l := uint32(len(g.sets))
+	start := atomic.AddUint32(&g.cursor, 1)
+	for i := uint32(0); i < l; i++ {
+		m := (*transport.SessionTCP)(atomic.LoadPointer(&c.sessions[g.sets[(start+i)%l]]))
+		if m != nil {
+			if err := m.WriteFrameDataToCache(fs, errFunc); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package sidecar
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/duomi520/domi/transport"
+)
+
+//重连退避时间
+var (
+	ReconnectBaseDuration = 100 * time.Millisecond //首次重连等待时间
+	ReconnectMaxDuration  = 30 * time.Second       //最大重连等待时间
+)
+
+//定义连接事件
+const (
+	LinkLost      uint16 = 1 + iota //连接断开
+	LinkRestored                    //连接恢复
+	LinkAbandoned                   //节点已离开集群，放弃重连
+)
+
+//LinkEvent 连接事件
+type LinkEvent struct {
+	MachineID int    //对端机器id
+	Operation uint16 //LinkLost、LinkRestored、LinkAbandoned
+	Attempts  int    //重连次数
+}
+
+//link 本节点主动建立的连接
+type link struct {
+	info Info
+	cli  *transport.ClientTCP
+}
+
+type reconnectResult struct {
+	link
+	attempts int
+}
+
+//LinkEvents 连接事件，缓存满时丢弃。
+func (s *Sidecar) LinkEvents() <-chan LinkEvent {
+	return s.linkChan
+}
+
+//emitLinkEvent 发送连接事件
+func (s *Sidecar) emitLinkEvent(e LinkEvent) {
+	select {
+	case s.linkChan <- e:
+	default:
+	}
+}
+
+//backoff 指数退避，加入随机抖动。
+func backoff(attempts int) time.Duration {
+	d := ReconnectBaseDuration
+	for i := 1; i < attempts && d < ReconnectMaxDuration; i++ {
+		d *= 2
+	}
+	if d > ReconnectMaxDuration {
+		d = ReconnectMaxDuration
+	}
+	//抖动范围 [d/2,d)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+//reconnect 按指数退避重连节点，节点已离开集群时放弃。
+func (s *Sidecar) reconnect(node Info) {
+	attempts := 0
+	for {
+		attempts++
+		select {
+		case <-time.After(backoff(attempts)):
+		case <-s.Ctx.Done():
+			return
+		}
+		if !s.isRegistered(node) {
+			s.Logger.Info("reconnect|节点已离开集群:", node.MachineID)
+			s.emitLinkEvent(LinkEvent{MachineID: node.MachineID, Operation: LinkAbandoned, Attempts: attempts})
+			return
+		}
+		cli, err := s.connect(node)
+		if err != nil {
+			s.Logger.Debug("reconnect|重连失败:", node.MachineID, " ", err.Error())
+			continue
+		}
+		select {
+		case s.reconnectChan <- reconnectResult{link: link{info: node, cli: cli}, attempts: attempts}:
+		case <-s.Ctx.Done():
+			cli.Csession.Close()
+		}
+		return
+	}
+}
+
+//isRegistered 节点仍以相同租约注册在集群中
+func (s *Sidecar) isRegistered(node Info) bool {
+	info, err := s.getNodeInfo(uint16(node.MachineID))
+	return err == nil && info.ID == node.ID
+}
+
+//OnPeerLost 注册回调，与节点的连接断开（LinkLost）或节点离开集群时调用。
+//在sidecar的协程中执行，不可阻塞，同一节点可能调用多次。
+func (c *cluster) OnPeerLost(f func(id uint16)) {
+	c.watchMutex.Lock()
+	c.peerLost = append(c.peerLost, f)
+	c.watchMutex.Unlock()
+}
+
+//OnChannelLeft 注册回调，节点退订频道时调用，在sidecar的协程中执行，不可阻塞。
+func (c *cluster) OnChannelLeft(f func(id, channel uint16)) {
+	c.watchMutex.Lock()
+	c.channelLeft = append(c.channelLeft, f)
+	c.watchMutex.Unlock()
+}
+
+//emitPeerLost 调用节点失联的回调
+func (c *cluster) emitPeerLost(id uint16) {
+	c.watchMutex.Lock()
+	fs := c.peerLost
+	c.watchMutex.Unlock()
+	for _, f := range fs {
+		f(id)
+	}
+}
+
+//emitChannelLeft 调用节点退订频道的回调
+func (c *cluster) emitChannelLeft(id, channel uint16) {
+	c.watchMutex.Lock()
+	fs := c.channelLeft
+	c.watchMutex.Unlock()
+	for _, f := range fs {
+		f(id, channel)
+	}
+}
@@ -0,0 +1,236 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duomi520/domi/util"
+)
+
+//memoryLeaseID 进程内唯一的租约id，http路由以租约id为前缀，需避免重复。
+var memoryLeaseID = time.Now().UnixNano()
+
+//MemoryRegistry 进程内的注册中心，代替etcd，用于测试及单机开发。
+type MemoryRegistry struct {
+	mutex    sync.Mutex
+	kv       map[string]memoryValue
+	watchers map[int64]*memoryDistributer
+}
+
+type memoryValue struct {
+	value string
+	lease int64 //0 无租约
+}
+
+//NewMemoryRegistry 新建
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		kv:       make(map[string]memoryValue, 256),
+		watchers: make(map[int64]*memoryDistributer, 16),
+	}
+}
+
+//NewDistributer 新建一个节点使用的Distributer，每个节点需单独新建。
+func (r *MemoryRegistry) NewDistributer() Distributer {
+	return &memoryDistributer{
+		registry:      r,
+		NodePrefix:    nodePrefix,
+		StatePrefix:   statePrefix,
+		ChannelPrefix: channelPrefix,
+		TopicPrefix:   topicPrefix,
+		stopChan:      make(chan struct{}),
+	}
+}
+
+//put 写入并通知所有节点，需持有锁。
+func (r *MemoryRegistry) put(key, value string, lease int64) {
+	r.kv[key] = memoryValue{value: value, lease: lease}
+	for _, w := range r.watchers {
+		w.notify(Event{Put: true, Key: []byte(key), Value: []byte(value)})
+	}
+}
+
+//delete 删除并通知所有节点，需持有锁。
+func (r *MemoryRegistry) delete(key string) {
+	v, ok := r.kv[key]
+	if !ok {
+		return
+	}
+	delete(r.kv, key)
+	for _, w := range r.watchers {
+		w.notify(Event{Put: false, Key: []byte(key), Value: []byte(v.value)})
+	}
+}
+
+//keys 按前缀取得排序后的键，需持有锁。
+func (r *MemoryRegistry) keys(prefix string) []string {
+	keys := make([]string, 0, 16)
+	for k := range r.kv {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//memoryDistributer 基于MemoryRegistry的Distributer
+type memoryDistributer struct {
+	registry *MemoryRegistry
+	leaseID  int64
+
+	NodePrefix, StatePrefix, ChannelPrefix, TopicPrefix string
+	eventChan                                           chan Event
+
+	eventMutex  sync.Mutex
+	events      []Event //待转发的事件，不限长度，避免持锁时阻塞。
+	eventSignal chan struct{}
+
+	initAddress []Info
+	stopChan    chan struct{}
+	closeOnce   sync.Once
+}
+
+//GetInitAddress 读
+func (m *memoryDistributer) GetInitAddress() []Info {
+	return m.initAddress
+}
+
+//RegisterServer 注册服务
+func (m *memoryDistributer) RegisterServer(info Info, _ interface{}) (int64, int, error) {
+	r := m.registry
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	m.initAddress = append(m.initAddress, info)
+	//取得机器id
+	l := len(m.NodePrefix)
+	used := make(map[int]bool, 16)
+	for _, k := range r.keys(m.NodePrefix) {
+		address := Info{}
+		if err := json.Unmarshal([]byte(r.kv[k].value), &address); err != nil {
+			return -1, -1, errors.New("RegisterServer|json解码错误：" + err.Error())
+		}
+		m.initAddress = append(m.initAddress, address)
+		used[int(util.BytesToUint16([]byte(k[l:])))] = true
+	}
+	id := -1
+	for i := 0; i < MaxWorkNumber; i++ {
+		if !used[i] {
+			id = i
+			break
+		}
+	}
+	if id == -1 {
+		return -1, -1, errors.New("RegisterServer|工作机器id已分配完")
+	}
+	m.leaseID = atomic.AddInt64(&memoryLeaseID, 1)
+	m.initAddress[0].MachineID = id
+	m.initAddress[0].ID = m.leaseID
+	//PUT 值
+	key := []byte(m.NodePrefix + "aa")
+	util.CopyUint16(key[l:], uint16(id))
+	value, err := json.Marshal(m.initAddress[0])
+	if err != nil {
+		return -1, -1, errors.New("RegisterServer|json编码失败: " + err.Error())
+	}
+	m.eventChan = make(chan Event, 128)
+	m.eventSignal = make(chan struct{}, 1)
+	r.watchers[m.leaseID] = m
+	r.put(string(key), string(value), m.leaseID)
+	go m.run()
+	return m.leaseID, id, nil
+}
+
+//DisconDistributer 释放，删除租约下的所有键。
+func (m *memoryDistributer) DisconDistributer() error {
+	r := m.registry
+	r.mutex.Lock()
+	delete(r.watchers, m.leaseID)
+	for k, v := range r.kv {
+		if v.lease == m.leaseID {
+			r.delete(k)
+		}
+	}
+	r.mutex.Unlock()
+	m.closeOnce.Do(func() {
+		close(m.stopChan)
+	})
+	return nil
+}
+
+//notify 加入待转发的事件
+func (m *memoryDistributer) notify(e Event) {
+	m.eventMutex.Lock()
+	m.events = append(m.events, e)
+	m.eventMutex.Unlock()
+	select {
+	case m.eventSignal <- struct{}{}:
+	default:
+	}
+}
+
+//run 按顺序转发事件，与etcd的watch语义一致。
+func (m *memoryDistributer) run() {
+	defer close(m.eventChan)
+	for {
+		select {
+		case <-m.eventSignal:
+			m.eventMutex.Lock()
+			events := m.events
+			m.events = nil
+			m.eventMutex.Unlock()
+			for _, ev := range events {
+				select {
+				case m.eventChan <- ev:
+				case <-m.stopChan:
+					return
+				}
+			}
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+//Events 键值变化事件
+func (m *memoryDistributer) Events() <-chan Event {
+	return m.eventChan
+}
+
+//PutKey p
+func (m *memoryDistributer) PutKey(ctx context.Context, key, value string) error {
+	m.registry.mutex.Lock()
+	m.registry.put(key, value, m.leaseID)
+	m.registry.mutex.Unlock()
+	return nil
+}
+
+//DeleteKey d
+func (m *memoryDistributer) DeleteKey(ctx context.Context, key string) error {
+	r := m.registry
+	r.mutex.Lock()
+	for _, k := range r.keys(key) {
+		r.delete(k)
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+//GetKey g
+func (m *memoryDistributer) GetKey(ctx context.Context, key string) ([][]byte, error) {
+	r := m.registry
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	keys := r.keys(key)
+	v := make([][]byte, len(keys))
+	for i, k := range keys {
+		v[i] = []byte(r.kv[k].value)
+	}
+	return v, nil
+}
@@ -0,0 +1,70 @@
+package sidecar
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//metricsOnce 同一进程内的节点共用http.DefaultServeMux及util.DefaultMetrics，/metrics 只注册一次。
+var metricsOnce sync.Once
+
+//serveMetrics 以Prometheus文本格式输出指标
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	util.DefaultMetrics.WriteTo(w)
+}
+
+//metricsLabels 本节点的指标标签
+func (s *Sidecar) metricsLabels() string {
+	return fmt.Sprintf(`machine="%d"`, s.MachineID)
+}
+
+//registerMetrics 注册本节点的指标
+func (s *Sidecar) registerMetrics() {
+	metricsOnce.Do(func() {
+		http.HandleFunc("/metrics", serveMetrics)
+	})
+	labels := s.metricsLabels()
+	util.DefaultMetrics.SetGauge("domi_dispatcher_backlog", "Number of jobs waiting for a dispatcher worker.", labels, func() float64 {
+		return float64(s.dispatcher.Len())
+	})
+	if s.limiter != nil {
+		util.DefaultMetrics.SetGauge("domi_limiter_tokens", "Number of tokens left in the limiter.", labels, func() float64 {
+			return float64(s.limiter.Tokens())
+		})
+	}
+	util.DefaultMetrics.SetGauge("domi_sessions", "Number of sessions to other nodes.", labels, func() float64 {
+		n := 0
+		for i := range s.sessions {
+			if atomic.LoadPointer(&s.sessions[i]) != nil {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	util.DefaultMetrics.SetGauge("domi_circuit_breakers_open", "Number of sessions whose circuit breaker is not closed.", labels, func() float64 {
+		n := 0
+		for i := range s.sessions {
+			m := (*transport.SessionTCP)(atomic.LoadPointer(&s.sessions[i]))
+			if m != nil {
+				if st := m.GetCircuitBreakerState(); st == util.StateCircuitBreakerOpen || st == util.StateCircuitBreakerHalfOpen {
+					n++
+				}
+			}
+		}
+		return float64(n)
+	})
+}
+
+//unregisterMetrics 注销本节点的指标
+func (s *Sidecar) unregisterMetrics() {
+	labels := s.metricsLabels()
+	for _, name := range []string{"domi_dispatcher_backlog", "domi_limiter_tokens", "domi_sessions", "domi_circuit_breakers_open"} {
+		util.DefaultMetrics.Remove(name, labels)
+	}
+}
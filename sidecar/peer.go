@@ -1,6 +1,7 @@
 package sidecar
 
 import (
+	"bytes"
 	"context"
 
 	"github.com/duomi520/domi/util"
@@ -17,8 +18,22 @@ type Distributer interface {
 	PutKey(context.Context, string, string) error
 	DeleteKey(context.Context, string) error
 	GetKey(context.Context, string) ([][]byte, error)
+	Events() <-chan Event
 }
 
+//Event 注册中心的键值变化，Distributer按发生顺序发出，DisconDistributer后关闭通道。
+type Event struct {
+	Put        bool //true 写入 false 删除
+	Key, Value []byte
+}
+
+//注册中心的键前缀
+const (
+	nodePrefix    = "machine/"
+	statePrefix   = "state/"
+	channelPrefix = "channel/"
+)
+
 //Info 地址信息
 type Info struct {
 	Name      string //服务名
@@ -40,9 +55,48 @@ type distributerChan struct {
 	StateChan   chan stateMsg
 	NodeChan    chan nodeMsg
 	ChannelChan chan channelMsg
+	TopicChan   chan topicMsg
+}
+
+//dispatch 将注册中心的键值变化按前缀解码后转发，通道关闭时退出。
+func (d *distributerChan) dispatch(events <-chan Event) {
+	for ev := range events {
+		switch {
+		case bytes.HasPrefix(ev.Key, []byte(nodePrefix)):
+			if !ev.Put {
+				var nc nodeMsg
+				nc.operation = 2
+				nc.id = getNodeID(ev.Key)
+				d.NodeChan <- nc
+			}
+		case bytes.HasPrefix(ev.Key, []byte(statePrefix)):
+			if ev.Put {
+				sm := bytesTOStateMsg(ev.Value)
+				sm.operation = 1
+				d.StateChan <- sm
+			}
+		case bytes.HasPrefix(ev.Key, []byte(channelPrefix)):
+			if ev.Put {
+				cm := valueTOChannelMsg(ev.Value)
+				cm.operation = 1
+				d.ChannelChan <- cm
+			} else {
+				cm := keyTOChannelMsg(ev.Key)
+				cm.operation = 2
+				d.ChannelChan <- cm
+			}
+		case bytes.HasPrefix(ev.Key, []byte(topicPrefix)):
+			tm := keyTOTopicMsg(ev.Key)
+			tm.operation = 2
+			if ev.Put {
+				tm.operation = 1
+			}
+			d.TopicChan <- tm
+		}
+	}
 }
 
-//newPeer 新增
+//newPeer 新增 operation为Distributer时使用该Distributer，否则视为etcd地址。
 func newPeer(name, HTTPPort, TCPPort string, operation interface{}) (*Peer, error) {
 	var err error
 	p := &Peer{}
@@ -53,19 +107,25 @@ func newPeer(name, HTTPPort, TCPPort string, operation interface{}) (*Peer, erro
 	if err != nil {
 		return nil, err
 	}
-	etcd := &etcd{
-		NodePrefix:    "machine/",
-		StatePrefix:   "state/",
-		ChannelPrefix: "channel/",
-		stopChan:      make(chan struct{}),
+	if d, ok := operation.(Distributer); ok {
+		p.Distributer = d
+	} else {
+		p.Distributer = &etcd{
+			NodePrefix:    nodePrefix,
+			StatePrefix:   statePrefix,
+			ChannelPrefix: channelPrefix,
+			TopicPrefix:   topicPrefix,
+			stopChan:      make(chan struct{}),
+		}
 	}
-	p.Distributer = etcd
 	p.ID, p.MachineID, err = p.RegisterServer(p.Info, operation)
 	if err != nil {
 		return nil, err
 	}
-	p.NodeChan = etcd.NodeChan
-	p.StateChan = etcd.StateChan
-	p.ChannelChan = etcd.ChannelChan
+	p.NodeChan = make(chan nodeMsg, 128)
+	p.StateChan = make(chan stateMsg, 128)
+	p.ChannelChan = make(chan channelMsg, 128)
+	p.TopicChan = make(chan topicMsg, 128)
+	go p.dispatch(p.Events())
 	return p, nil
 }
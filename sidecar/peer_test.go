@@ -1,11 +1,12 @@
 package sidecar
 
 import (
+	"context"
 	"testing"
 	"time"
 )
 
-//需先启动 etcd
+//使用etcd时需先启动 etcd
 //设置api版本  ./set ETCDCTL_API=3
 //读取所有key  ./etcdctl get --from-key ''
 /*
@@ -17,18 +18,19 @@ machine/╗
 {"Name":"2/server","Address":"192.168.1.5","HTTPPort":":7080","TCPPort":":9522","ID":7587831686899188249,"MachineID":2}
 */
 
-var testEndpoints = []string{"localhost:2379"}
+//使用进程内的注册中心，无需启动etcd。
+var testRegistry = NewMemoryRegistry()
 
 func Test_newPeer(t *testing.T) {
-	p0, err := newPeer("0/server", ":7080", ":9520", testEndpoints)
+	p0, err := newPeer("0/server", ":7080", ":9520", testRegistry.NewDistributer())
 	if err != nil {
 		t.Fatal(err)
 	}
-	p1, err := newPeer("1/server", ":7080", ":9521", testEndpoints)
+	p1, err := newPeer("1/server", ":7080", ":9521", testRegistry.NewDistributer())
 	if err != nil {
 		t.Fatal(err)
 	}
-	p2, err := newPeer("2/server", ":7080", ":9522", testEndpoints)
+	p2, err := newPeer("2/server", ":7080", ":9522", testRegistry.NewDistributer())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,3 +43,34 @@ func Test_newPeer(t *testing.T) {
 	p1.DisconDistributer()
 	p2.DisconDistributer()
 }
+
+func Test_memoryRegistry(t *testing.T) {
+	r := NewMemoryRegistry()
+	p0, err := newPeer("0/server", ":7080", ":9530", r.NewDistributer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := newPeer("1/server", ":7080", ":9531", r.NewDistributer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p0.MachineID != 0 || p1.MachineID != 1 || p0.ID == p1.ID {
+		t.Fatal(p0.Info, p1.Info)
+	}
+	p1.PutKey(context.TODO(), "channel/\x37\x00/\x01\x00", "\x01\x00\x37\x00")
+	cm := <-p0.ChannelChan
+	if cm.operation != 1 || cm.id != 1 || cm.channel != 55 {
+		t.Fatal(cm)
+	}
+	//释放租约时删除该节点的所有键
+	p1.DisconDistributer()
+	nm := <-p0.NodeChan
+	cm = <-p0.ChannelChan
+	if nm.operation != 2 || nm.id != 1 || cm.operation != 2 || cm.channel != 55 {
+		t.Fatal(nm, cm)
+	}
+	if v, _ := p0.GetKey(context.TODO(), "machine/"); len(v) != 1 {
+		t.Fatal(len(v))
+	}
+	p0.DisconDistributer()
+}
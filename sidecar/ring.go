@@ -0,0 +1,98 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+
+	"github.com/duomi520/domi/transport"
+)
+
+//ringReplicas 每个节点在一致性哈希环上的虚拟节点数
+const ringReplicas = 160
+
+//ringNode 一致性哈希环上的虚拟节点
+type ringNode struct {
+	hash uint32
+	id   uint16
+}
+
+//hashKey fnv-1a，再经murmur3的fmix32打散，避免短键聚集。
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	v := h.Sum32()
+	v ^= v >> 16
+	v *= 0x85ebca6b
+	v ^= v >> 13
+	v *= 0xc2b2ae35
+	v ^= v >> 16
+	return v
+}
+
+//buildRing 以bucket.sets建立一致性哈希环，节点增减时只有约1/n的键改变归属。
+func (b *bucket) buildRing() {
+	b.ring = make([]ringNode, 0, len(b.sets)*ringReplicas)
+	v := make([]byte, 4)
+	for _, id := range b.sets {
+		v[0], v[1] = byte(id>>8), byte(id)
+		for i := 0; i < ringReplicas; i++ {
+			v[2], v[3] = byte(i>>8), byte(i)
+			b.ring = append(b.ring, ringNode{hash: hashKey(v), id: id})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		if b.ring[i].hash == b.ring[j].hash {
+			return b.ring[i].id < b.ring[j].id
+		}
+		return b.ring[i].hash < b.ring[j].hash
+	})
+}
+
+//locate 键在环上的起始位置
+func (b *bucket) locate(key []byte) int {
+	h := hashKey(key)
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return i
+}
+
+//AskKey 按键请求某一个，相同的键发往同一节点，节点不可用时沿环顺序选择下一节点。返回发送的机器id，失败时返回-1。
+func (c *cluster) AskKey(channel uint16, key []byte, fs transport.FrameSlice, errFunc func(error)) int {
+	b := (*bucket)(atomic.LoadPointer(&c.channels[channel]))
+	if b == nil || len(b.ring) == 0 {
+		errFunc(fmt.Errorf("AskKey|bucket 未发现频道 %d", channel))
+		return -1
+	}
+	l := len(b.ring)
+	start := b.locate(key)
+	tried := make([]uint16, 0, 4)
+	for i := 0; i < l && len(tried) < len(b.sets); i++ {
+		id := b.ring[(start+i)%l].id
+		if containsUint16(tried, id) {
+			continue
+		}
+		tried = append(tried, id)
+		m := (*transport.SessionTCP)(atomic.LoadPointer(&c.sessions[id]))
+		if m != nil {
+			if err := m.WriteFrameDataToCache(fs, errFunc); err == nil {
+				return int(id)
+			}
+		}
+	}
+	errFunc(errors.New("AskKey|没有可用的节点。"))
+	return -1
+}
+
+func containsUint16(s []uint16, v uint16) bool {
+	for _, n := range s {
+		if n == v {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package sidecar
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -20,13 +22,20 @@ type Sidecar struct {
 	dispatcher              *util.Dispatcher
 	limiter                 *util.Limiter
 	circuitBreakerConfigure *util.CircuitBreakerConfigure
+	security                *transport.SecurityConfigure
+	authenticator           *transport.Authenticator
 
-	tcpServer  *transport.ServerTCP
-	httpServer *http.Server
+	tcpServer   *transport.ServerTCP
+	httpServer  *http.Server
+	adminServer *http.Server //独立的管理监听，可为nil
+	admin       *AdminConfigure
+	audit       *util.Logger //审计日志
 
 	*cluster
 
-	readyChan chan struct{}
+	readyChan     chan struct{}
+	reconnectChan chan reconnectResult //重连成功的连接
+	linkChan      chan LinkEvent       //连接事件
 
 	doOnce sync.Once
 
@@ -36,14 +45,18 @@ type Sidecar struct {
 }
 
 //NewSidecar 新建
-func NewSidecar(ctx context.Context, cancel func(), name, HTTPPort, TCPPort string, operation interface{}, lc *util.LimiterConfigure, cc *util.CircuitBreakerConfigure) *Sidecar {
+func NewSidecar(ctx context.Context, cancel func(), name, HTTPPort, TCPPort string, operation interface{}, lc *util.LimiterConfigure, cc *util.CircuitBreakerConfigure, sc *transport.SecurityConfigure, ac *AdminConfigure) *Sidecar {
 	logger, _ := util.NewLogger(util.DebugLevel, "")
 	s := &Sidecar{
-		Ctx:       ctx,
-		exitFunc:  cancel,
-		Handler:   transport.NewHandler(),
-		readyChan: make(chan struct{}),
-		Logger:    logger,
+		Ctx:           ctx,
+		exitFunc:      cancel,
+		Handler:       transport.NewHandler(),
+		readyChan:     make(chan struct{}),
+		reconnectChan: make(chan reconnectResult, 16),
+		linkChan:      make(chan LinkEvent, 128),
+		security:      sc,
+		admin:         ac,
+		Logger:        logger,
 	}
 	var err error
 	//监视
@@ -68,12 +81,22 @@ func NewSidecar(ctx context.Context, cancel func(), name, HTTPPort, TCPPort stri
 		s.circuitBreakerConfigure = cc
 	}
 	//tcp支持
-	s.tcpServer = transport.NewServerTCP(ctx, TCPPort, s.Handler, s.dispatcher, s.limiter, s.circuitBreakerConfigure)
+	s.tcpServer = transport.NewServerTCP(ctx, TCPPort, s.Handler, s.dispatcher, s.limiter, s.circuitBreakerConfigure, s.security)
 	if s.tcpServer == nil {
 		s.Logger.Error("NewSidecar|NewServerTCP失败:" + TCPPort)
 		return nil
 	}
 	s.tcpServer.Logger.SetMark(fmt.Sprintf("%d", s.MachineID))
+	//握手认证
+	if sc != nil && len(sc.Secret) > 0 {
+		s.authenticator = &transport.Authenticator{
+			Secret:    sc.Secret,
+			MachineID: s.machineID,
+			LeaseID:   s.ID,
+			Verify:    s.verifyPeer,
+		}
+		s.tcpServer.Authenticator = s.authenticator
+	}
 	s.HandleFunc(transport.FrameTypeNodeName, s.addSessionTCP)
 	//http支持
 	s.httpServer = &http.Server{
@@ -85,7 +108,12 @@ func NewSidecar(ctx context.Context, cancel func(), name, HTTPPort, TCPPort stri
 	}
 	pre := fmt.Sprintf("/%d", s.ID)
 	http.HandleFunc(pre+"/ping", s.echo)
-	http.HandleFunc(pre+"/exit", s.exit)
+	if err := s.handleExit(pre); err != nil {
+		s.Logger.Error("NewSidecar|" + err.Error())
+		return nil
+	}
+	s.handleAdmin(pre)
+	s.registerMetrics()
 	s.Logger.SetMark(fmt.Sprintf("Sidecar.%d", s.MachineID))
 	return s
 }
@@ -104,7 +132,6 @@ func (s *Sidecar) WaitInit() {
 func (s *Sidecar) Run() {
 	s.Logger.Info(fmt.Sprintf("Run|%d 启动……", s.ID))
 	//启动心跳
-	heartbeatSlice := make([]*transport.ClientTCP, len(s.GetInitAddress()))
 	heartbeat := time.NewTicker(transport.DefaultHeartbeatDuration)
 	defer heartbeat.Stop()
 	//启动限流器
@@ -118,12 +145,20 @@ func (s *Sidecar) Run() {
 			s.Logger.Debug("Run|", err.Error())
 		}
 	}()
+	if s.adminServer != nil {
+		go func() {
+			s.Logger.Info("Run|管理监听端口", s.adminServer.Addr)
+			if err := s.adminServer.ListenAndServe(); err != nil {
+				s.Logger.Debug("Run|", err.Error())
+			}
+		}()
+	}
 	//启动tcp
 	go s.dispatcher.Run()
 	s.Logger.Info("Run|TCP监听端口", s.TCPPort)
 	s.RunAssembly(s.tcpServer)
 	//与其它服务器建立连接
-	s.dialNode(heartbeatSlice)
+	heartbeatSlice := s.dialNode()
 	s.RunAssembly(s.cluster)
 	s.SetState(util.StateWork)
 	close(s.readyChan)
@@ -133,7 +168,11 @@ func (s *Sidecar) Run() {
 			i := 0
 			l := len(heartbeatSlice)
 			for i < l {
-				if err := heartbeatSlice[i].Heartbeat(); err != nil {
+				if err := heartbeatSlice[i].cli.Heartbeat(); err != nil {
+					//断线重连
+					s.emitLinkEvent(LinkEvent{MachineID: heartbeatSlice[i].info.MachineID, Operation: LinkLost})
+					s.emitPeerLost(uint16(heartbeatSlice[i].info.MachineID))
+					go s.reconnect(heartbeatSlice[i].info)
 					copy(heartbeatSlice[i:l-1], heartbeatSlice[i+1:])
 					heartbeatSlice = heartbeatSlice[:l-1]
 					l--
@@ -141,15 +180,27 @@ func (s *Sidecar) Run() {
 				}
 				i++
 			}
+		case rl := <-s.reconnectChan:
+			if err := s.attach(rl.info, rl.cli); err != nil {
+				s.Logger.Error("Run|错误：" + err.Error())
+				go s.reconnect(rl.info)
+				continue
+			}
+			heartbeatSlice = append(heartbeatSlice, rl.link)
+			s.emitLinkEvent(LinkEvent{MachineID: rl.info.MachineID, Operation: LinkRestored, Attempts: rl.attempts})
 		case <-s.Ctx.Done():
 			s.Logger.Info("Run|等待子模块关闭……")
 			s.SetState(util.StateDie)
 			s.Wait()
 			s.httpServer.Shutdown(context.TODO())
+			if s.adminServer != nil {
+				s.adminServer.Shutdown(context.TODO())
+			}
 			s.dispatcher.Close()
 			if s.limiter != nil {
 				s.limiter.Close()
 			}
+			s.unregisterMetrics()
 			s.Logger.Info("Run|Sidecar关闭。")
 			if err := s.DisconDistributer(); err != nil {
 				s.Logger.Error(err)
@@ -168,27 +219,54 @@ func (s *Sidecar) getURLTCP(u Info) string {
 }
 
 //dialNode 与其它服务器建立连接
-func (s *Sidecar) dialNode(heartbeatSlice []*transport.ClientTCP) {
-	data := make([]byte, 2)
-	fs := transport.NewFrameSlice(transport.FrameTypeNodeName, data, nil)
-	for i, node := range s.GetInitAddress() {
-		cli, err := transport.NewClientTCP(s.Ctx, s.getURLTCP(node), s.Handler, s.dispatcher, s.limiter, s.circuitBreakerConfigure)
-		if err != nil {
-			s.Logger.Error("Run|错误：" + err.Error())
-			continue
+func (s *Sidecar) dialNode() []link {
+	links := make([]link, 0, len(s.GetInitAddress()))
+	for _, node := range s.GetInitAddress() {
+		cli, err := s.connect(node)
+		if err == nil {
+			err = s.attach(node, cli)
 		}
-		cli.Logger.SetMark(fmt.Sprintf("%d", s.MachineID))
-		s.RunAssembly(cli)
-		util.CopyUint16(fs.GetData(), s.machineID)
-		err = cli.Csession.WriteFrameDataPromptly(fs)
 		if err != nil {
 			s.Logger.Error("Run|错误：" + err.Error())
+			go s.reconnect(node)
 			continue
-		} else {
-			s.NodeChan <- nodeMsg{id: uint16(node.MachineID), ss: cli.Csession, operation: 3}
-			heartbeatSlice[i] = cli
+		}
+		links = append(links, link{info: node, cli: cli})
+	}
+	return links
+}
+
+//connect 连接节点并完成握手认证
+func (s *Sidecar) connect(node Info) (*transport.ClientTCP, error) {
+	cli, err := transport.NewClientTCP(s.Ctx, s.getURLTCP(node), s.Handler, s.dispatcher, s.limiter, s.circuitBreakerConfigure, s.security)
+	if err != nil {
+		return nil, err
+	}
+	cli.Logger.SetMark(fmt.Sprintf("%d", s.MachineID))
+	if s.authenticator != nil {
+		if err = cli.Handshake(s.authenticator); err != nil {
+			cli.Csession.Close()
+			return nil, err
+		}
+		if id, _ := cli.Csession.GetPeer(); id != uint16(node.MachineID) {
+			cli.Csession.Close()
+			return nil, fmt.Errorf("connect|对端机器id %d 与注册信息 %d 不符。", id, node.MachineID)
 		}
 	}
+	return cli, nil
+}
+
+//attach 运行连接，发送本节点机器id，并加入会话表
+func (s *Sidecar) attach(node Info, cli *transport.ClientTCP) error {
+	data := make([]byte, 2)
+	util.CopyUint16(data, s.machineID)
+	s.RunAssembly(cli)
+	if err := cli.Csession.WriteFrameDataPromptly(transport.NewFrameSlice(transport.FrameTypeNodeName, data, nil)); err != nil {
+		cli.Csession.Close()
+		return err
+	}
+	s.NodeChan <- nodeMsg{id: uint16(node.MachineID), ss: cli.Csession, operation: 3}
+	return nil
 }
 
 //echo Ping 回复 pong
@@ -196,18 +274,48 @@ func (s *Sidecar) echo(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "pong")
 }
 
-//exit 退出  TODO 安全 加认证
-func (s *Sidecar) exit(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "exit")
-	s.doOnce.Do(func() {
-		s.exitFunc()
-	})
+//verifyPeer 校验对端声明的机器id及租约id与注册信息一致
+func (s *Sidecar) verifyPeer(id uint16, lease int64) error {
+	info, err := s.getNodeInfo(id)
+	if err != nil {
+		return err
+	}
+	if info.MachineID != int(id) || info.ID != lease {
+		return fmt.Errorf("verifyPeer|机器id %d 租约 %d 与注册信息不符。", id, lease)
+	}
+	return nil
+}
+
+//getNodeInfo 读取节点的注册信息
+func (s *Sidecar) getNodeInfo(id uint16) (Info, error) {
+	info := Info{}
+	key := []byte("machine/xx")
+	util.CopyUint16(key[len(key)-2:], id)
+	v, err := s.GetKey(context.TODO(), string(key))
+	if err != nil {
+		return info, err
+	}
+	if len(v) == 0 {
+		return info, fmt.Errorf("getNodeInfo|机器id %d 未注册。", id)
+	}
+	if err := json.Unmarshal(v[0], &info); err != nil {
+		return info, errors.New("getNodeInfo|json解码错误：" + err.Error())
+	}
+	return info, nil
 }
 
 //addSessionTCP 用户连接时
 func (s *Sidecar) addSessionTCP(se transport.Session) error {
 	ft := se.GetFrameSlice()
 	id := util.BytesToUint16(ft.GetData())
+	if s.authenticator != nil {
+		ss := se.(*transport.SessionTCP)
+		if peer, ok := ss.GetPeer(); !ok || peer != id {
+			s.Logger.Error(fmt.Sprintf("addSessionTCP|拒绝未认证的节点 %d,来自 %s。", id, ss.Conn.RemoteAddr()))
+			ss.Close()
+			return nil
+		}
+	}
 	if s.machineID != id {
 		s.NodeChan <- nodeMsg{id: id, ss: se.(*transport.SessionTCP), operation: 3}
 	}
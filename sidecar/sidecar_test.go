@@ -2,14 +2,19 @@ package sidecar
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/duomi520/domi/transport"
+	"io/ioutil"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-//需先启动 etcd
 func test4Sidecar(port int) (*Sidecar, *Sidecar, *Sidecar, *Sidecar) {
 	p1 := strconv.Itoa(port)
 	p2 := strconv.Itoa(port + 1)
@@ -19,16 +24,16 @@ func test4Sidecar(port int) (*Sidecar, *Sidecar, *Sidecar, *Sidecar) {
 	ctx2, ctxExitFunc2 := context.WithCancel(context.Background())
 	ctx3, ctxExitFunc3 := context.WithCancel(context.Background())
 	ctx4, ctxExitFunc4 := context.WithCancel(context.Background())
-	sc1 := NewSidecar(ctx1, ctxExitFunc1, "1/server", ":7"+p1, ":9"+p1, testEndpoints, nil, nil)
+	sc1 := NewSidecar(ctx1, ctxExitFunc1, "1/server", ":7"+p1, ":9"+p1, testRegistry.NewDistributer(), nil, nil, nil, nil)
 	go sc1.Run()
 	sc1.WaitInit()
-	sc2 := NewSidecar(ctx2, ctxExitFunc2, "2/server", ":7"+p2, ":9"+p2, testEndpoints, nil, nil)
+	sc2 := NewSidecar(ctx2, ctxExitFunc2, "2/server", ":7"+p2, ":9"+p2, testRegistry.NewDistributer(), nil, nil, nil, nil)
 	go sc2.Run()
 	sc2.WaitInit()
-	sc3 := NewSidecar(ctx3, ctxExitFunc3, "3/server", ":7"+p3, ":9"+p3, testEndpoints, nil, nil)
+	sc3 := NewSidecar(ctx3, ctxExitFunc3, "3/server", ":7"+p3, ":9"+p3, testRegistry.NewDistributer(), nil, nil, nil, nil)
 	go sc3.Run()
 	sc3.WaitInit()
-	sc4 := NewSidecar(ctx4, ctxExitFunc4, "4/server", ":7"+p4, ":9"+p4, testEndpoints, nil, nil)
+	sc4 := NewSidecar(ctx4, ctxExitFunc4, "4/server", ":7"+p4, ":9"+p4, testRegistry.NewDistributer(), nil, nil, nil, nil)
 	go sc4.Run()
 	sc4.WaitInit()
 	return sc1, sc2, sc3, sc4
@@ -134,3 +139,340 @@ func Test_conver(t *testing.T) {
 		t.Fatal("失败:", c, l, d, tc, tl, setCursorAndLenght(0, 0))
 	}
 }
+
+func Test_backoff(t *testing.T) {
+	last := time.Duration(0)
+	for i := 1; i < 20; i++ {
+		d := backoff(i)
+		if d < ReconnectBaseDuration/2 || d > ReconnectMaxDuration {
+			t.Fatal("越界:", i, d)
+		}
+		if i < 5 && d < last/2 {
+			t.Fatal("未递增:", i, d, last)
+		}
+		last = d
+	}
+}
+
+func Test_reconnect(t *testing.T) {
+	ctx1, ctxExitFunc1 := context.WithCancel(context.Background())
+	sc1 := NewSidecar(ctx1, ctxExitFunc1, "1/server", ":7170", ":9170", testRegistry.NewDistributer(), nil, nil, nil, nil)
+	go sc1.Run()
+	sc1.WaitInit()
+	ctx2, ctxExitFunc2 := context.WithCancel(context.Background())
+	sc2 := NewSidecar(ctx2, ctxExitFunc2, "2/server", ":7171", ":9171", testRegistry.NewDistributer(), nil, nil, nil, nil)
+	go sc2.Run()
+	sc2.WaitInit()
+	defer func() {
+		ctxExitFunc1()
+		ctxExitFunc2()
+		time.Sleep(600 * time.Millisecond)
+	}()
+	received := make(chan string, 16)
+	sc1.HandleFunc(2001, func(s transport.Session) error {
+		received <- string(s.GetFrameSlice().GetData())
+		return nil
+	})
+	sc1.SetChannel(sc1.machineID, 2001, 3)
+	time.Sleep(350 * time.Millisecond)
+	ask := func(data string) {
+		sc2.AskOne(2001, transport.NewFrameSlice(2001, []byte(data), nil), func(err error) {
+			t.Error(err)
+		})
+		select {
+		case v := <-received:
+			if v != data {
+				t.Fatal("数据:", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("未收到:", data)
+		}
+	}
+	ask("before")
+	//新节点主动连接，心跳失败时断线重连。
+	ss := (*transport.SessionTCP)(atomic.LoadPointer(&sc2.sessions[sc1.machineID]))
+	if ss == nil {
+		t.Fatal("无会话")
+	}
+	ss.Close()
+	wait := func(operation uint16) {
+		timeout := time.After(3 * transport.DefaultHeartbeatDuration)
+		for {
+			select {
+			case e := <-sc2.LinkEvents():
+				if e.MachineID == int(sc1.machineID) && e.Operation == operation {
+					return
+				}
+			case <-timeout:
+				t.Fatal("未收到连接事件:", operation)
+			}
+		}
+	}
+	wait(LinkLost)
+	wait(LinkRestored)
+	time.Sleep(150 * time.Millisecond)
+	ask("after")
+}
+
+func Test_balancer(t *testing.T) {
+	sets := []uint16{1, 2, 3}
+	load := func(id uint16) int64 {
+		return int64(id)
+	}
+	count := make(map[uint16]int)
+	wrr := NewWeightedRoundRobinBalancer(map[uint16]int{1: 5})
+	for i := 0; i < 70; i++ {
+		count[wrr.Pick(sets, load)]++
+	}
+	if count[1] != 50 || count[2] != 10 || count[3] != 10 {
+		t.Fatal("WeightedRoundRobin:", count)
+	}
+	for i := 0; i < 10; i++ {
+		if id := (LeastOutstandingBalancer{}).Pick(sets, load); id != 1 {
+			t.Fatal("LeastOutstanding:", id)
+		}
+		if id := (PowerOfTwoBalancer{}).Pick(sets, load); id == 3 {
+			t.Fatal("PowerOfTwo:", id)
+		}
+	}
+	count = make(map[uint16]int)
+	for i := 0; i < 300; i++ {
+		count[(RandomBalancer{}).Pick(sets, load)]++
+	}
+	if len(count) != 3 {
+		t.Fatal("Random:", count)
+	}
+}
+
+func Test_ring(t *testing.T) {
+	b3 := newBucket()
+	for _, id := range []uint16{1, 2, 3} {
+		b3.add(b3.sets, id)
+	}
+	b4 := newBucket()
+	b4.add(b3.sets, 4)
+	b2 := newBucket()
+	b2.remove(b3.sets, 2)
+	count := make(map[uint16]int)
+	moved, total := 0, 3000
+	for i := 0; i < total; i++ {
+		key := []byte(fmt.Sprintf("room%d", i))
+		id := b3.ring[b3.locate(key)].id
+		count[id]++
+		if nid := b4.ring[b4.locate(key)].id; nid != id {
+			if nid != 4 {
+				t.Fatal("加入节点后键移到旧节点:", id, nid)
+			}
+			moved++
+		}
+		if nid := b2.ring[b2.locate(key)].id; id != 2 && nid != id {
+			t.Fatal("删除节点后其它节点的键移动:", id, nid)
+		}
+	}
+	//理想为1/4
+	if moved < total/8 || moved > total/2 {
+		t.Fatal("移动的键比例异常:", moved, total)
+	}
+	for _, id := range []uint16{1, 2, 3} {
+		if count[id] < total/6 {
+			t.Fatal("分布不均:", count)
+		}
+	}
+}
+
+func Test_group(t *testing.T) {
+	var b *bucket
+	for i, group := range []string{"a", "", "b", "a"} {
+		nb := newBucket()
+		if b == nil {
+			nb.add(nil, uint16(i))
+		} else {
+			nb.add(b.sets, uint16(i))
+		}
+		nb.setGroups(b, uint16(i), group)
+		b = nb
+	}
+	if len(b.groups) != 2 || b.groups[0].name != "a" || len(b.groups[0].sets) != 2 || b.groups[1].name != "b" {
+		t.Fatal(b.groups)
+	}
+	//退订及改为普通订阅
+	nb := newBucket()
+	nb.remove(b.sets, 0)
+	nb.setGroups(b, 0, "")
+	b = nb
+	nb = newBucket()
+	nb.add(b.sets, 2)
+	nb.setGroups(b, 2, "")
+	if len(nb.groups) != 1 || len(nb.groups[0].sets) != 1 || nb.groups[0].sets[0] != 3 || len(nb.groupOf) != 1 {
+		t.Fatal(nb.groups, nb.groupOf)
+	}
+}
+
+func Test_topic(t *testing.T) {
+	for _, v := range []string{"", "a..b", "a.b*", "a.>.b", "a/b", strings.Repeat("a", 256)} {
+		if ValidTopic(v, true) == nil {
+			t.Fatal(v)
+		}
+	}
+	if ValidTopic("a.*.>", true) != nil || ValidTopic("a.*", false) == nil {
+		t.Fatal("通配符")
+	}
+	cases := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"chat.room.42.msg", "chat.room.42.msg", true},
+		{"chat.room.*.msg", "chat.room.42.msg", true},
+		{"chat.room.*", "chat.room.42.msg", false},
+		{"chat.>", "chat.room.42.msg", true},
+		{"chat.room.42.msg.>", "chat.room.42.msg", false},
+		{"chat.room", "chat.room.42", false},
+		{"chat.room.42", "chat.room", false},
+	}
+	tt := newTopicTrie()
+	for i, c := range cases {
+		if MatchTopic(c.pattern, c.topic) != c.match {
+			t.Fatal(c)
+		}
+		tt.add(c.pattern, uint16(i))
+	}
+	ids := tt.match("chat.room.42.msg")
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if fmt.Sprint(ids) != "[0 1 3]" {
+		t.Fatal(ids)
+	}
+	tt.remove("chat.>", 3)
+	tt.remove("chat.room.42.msg", 0)
+	if ids := tt.match("chat.room.42.msg"); len(ids) != 1 || ids[0] != 1 {
+		t.Fatal(ids)
+	}
+	if v := keyTOTopicMsg([]byte("topic/\x05\x00a.b/")); v.id != 5 || v.topic != "a.b" {
+		t.Fatal(v)
+	}
+}
+
+func Test_admin(t *testing.T) {
+	sc1, sc2, sc3, sc4 := test4Sidecar(140)
+	sc2.SetChannel(sc2.machineID, 60, 3)
+	time.Sleep(350 * time.Millisecond)
+	get := func(path string, v interface{}) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1%s/%d%s", sc2.HTTPPort, sc2.ID, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(path, err)
+		}
+	}
+	var nodes []NodeStatus
+	get("/nodes", &nodes)
+	found := false
+	for _, n := range nodes {
+		if n.ID == sc2.ID && n.State == "work" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("nodes:", nodes)
+	}
+	var channels []ChannelStatus
+	get("/channels", &channels)
+	found = false
+	for _, c := range channels {
+		if c.Channel == 60 && len(c.MachineIDs) == 1 && c.MachineIDs[0] == sc2.machineID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("channels:", channels)
+	}
+	var subscriptions []uint16
+	get("/subscriptions", &subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0] != 60 {
+		t.Fatal("subscriptions:", subscriptions)
+	}
+	var sessions []SessionStatus
+	get("/sessions", &sessions)
+	if len(sessions) < 4 || sessions[0].State != "work" || sessions[0].CircuitBreaker != "closed" {
+		t.Fatal("sessions:", sessions)
+	}
+	var stats Stats
+	get("/stats", &stats)
+	if stats.MachineID != sc2.MachineID || stats.LimiterEnabled {
+		t.Fatal("stats:", stats)
+	}
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1%s/%d/stats", sc2.HTTPPort, sc2.ID), "", nil)
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("POST:", err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1%s/metrics", sc2.HTTPPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, v := range []string{"domi_transport_frames_received_total ", fmt.Sprintf(`domi_sessions{machine="%d"} `, sc2.MachineID)} {
+		if !strings.Contains(string(metrics), v) {
+			t.Fatal("metrics:", v, string(metrics))
+		}
+	}
+	sc1.exitFunc()
+	sc2.exitFunc()
+	sc3.exitFunc()
+	sc4.exitFunc()
+	time.Sleep(600 * time.Millisecond)
+}
+
+func Test_exit(t *testing.T) {
+	ctx1, ctxExitFunc1 := context.WithCancel(context.Background())
+	ac1 := &AdminConfigure{Token: "token", Secret: []byte("secret"), Address: ":7152"}
+	sc1 := NewSidecar(ctx1, ctxExitFunc1, "1/server", ":7150", ":9150", testRegistry.NewDistributer(), nil, nil, nil, ac1)
+	go sc1.Run()
+	sc1.WaitInit()
+	ctx2, ctxExitFunc2 := context.WithCancel(context.Background())
+	ac2 := &AdminConfigure{Token: "token", AllowIPs: []string{"192.0.2.1"}}
+	sc2 := NewSidecar(ctx2, ctxExitFunc2, "2/server", ":7151", ":9151", testRegistry.NewDistributer(), nil, nil, nil, ac2)
+	go sc2.Run()
+	sc2.WaitInit()
+	time.Sleep(150 * time.Millisecond)
+	do := func(method, addr string, id int64, f func(*http.Request)) int {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1%s/%d/exit", addr, id), nil)
+		if f != nil {
+			f(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }
+	if code := do(http.MethodGet, ":7152", sc1.ID, bearer); code != http.StatusMethodNotAllowed {
+		t.Fatal("GET:", code)
+	}
+	if code := do(http.MethodPost, ":7150", sc1.ID, bearer); code != http.StatusNotFound {
+		t.Fatal("HTTP端口:", code)
+	}
+	if code := do(http.MethodPost, ":7152", sc1.ID, func(r *http.Request) { r.Header.Set("Authorization", "Bearer bad") }); code != http.StatusUnauthorized {
+		t.Fatal("令牌:", code)
+	}
+	if code := do(http.MethodPost, ":7151", sc2.ID, bearer); code != http.StatusForbidden {
+		t.Fatal("允许列表:", code)
+	}
+	if code := do(http.MethodPost, ":7152", sc1.ID, func(r *http.Request) { SignAdminRequest(r, []byte("secret")) }); code != http.StatusOK {
+		t.Fatal("签名:", code)
+	}
+	select {
+	case <-ctx1.Done():
+	case <-time.After(time.Second):
+		t.Fatal("未关闭")
+	}
+	if ctx2.Err() != nil {
+		t.Fatal("sc2 被关闭")
+	}
+	ctxExitFunc2()
+	time.Sleep(600 * time.Millisecond)
+}
@@ -0,0 +1,277 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//定义错误
+var (
+	ErrTopicInvalid = errors.New("sidecar.ValidTopic|主题无效。")
+	ErrTopicTooLong = errors.New("sidecar.ValidTopic|主题超过255字节。")
+)
+
+//MaxTopicLength 主题的最大长度
+const MaxTopicLength = 255
+
+/*
+主题由'.'分隔的若干段组成，如 chat.room.42.msg，订阅时可使用通配符：
+	*	匹配一段
+	>	匹配之后的一段或多段，只能位于最后
+key: "topic/xx主题/"	xx 2字节机器id，以'/'结尾避免按前缀删除时误删		值： 2字节机器id、主题
+*/
+
+//topicPrefix 主题订阅的键前缀
+const topicPrefix = "topic/"
+
+//ValidTopic 检查主题，wildcard为true时允许通配符。
+func ValidTopic(topic string, wildcard bool) error {
+	if len(topic) > MaxTopicLength {
+		return ErrTopicTooLong
+	}
+	if topic == "" {
+		return ErrTopicInvalid
+	}
+	tokens := strings.Split(topic, ".")
+	for i, t := range tokens {
+		switch {
+		case t == "":
+			return ErrTopicInvalid
+		case t == "*" || t == ">":
+			if !wildcard || (t == ">" && i != len(tokens)-1) {
+				return ErrTopicInvalid
+			}
+		case strings.ContainsAny(t, "*>/"):
+			return ErrTopicInvalid
+		}
+	}
+	return nil
+}
+
+//MatchTopic 主题是否与订阅的主题匹配
+func MatchTopic(pattern, topic string) bool {
+	for {
+		p, pr, pok := cutTopic(pattern)
+		t, tr, tok := cutTopic(topic)
+		if p == ">" {
+			return t != ""
+		}
+		if t == "" || (p != "*" && p != t) {
+			return false
+		}
+		if !pok || !tok {
+			return pok == tok
+		}
+		pattern, topic = pr, tr
+	}
+}
+
+//cutTopic 取出第一段
+func cutTopic(s string) (string, string, bool) {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+//topicNode 前缀树节点
+type topicNode struct {
+	children map[string]*topicNode
+	members  map[uint16]struct{} //在此结束的订阅
+	rest     map[uint16]struct{} //在此之后为'>'的订阅
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+//topicTrie 集群中各节点订阅的主题
+type topicTrie struct {
+	mutex sync.RWMutex
+	root  *topicNode
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: newTopicNode()}
+}
+
+//add 加入订阅
+func (tt *topicTrie) add(pattern string, id uint16) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+	n := tt.root
+	for _, t := range strings.Split(pattern, ".") {
+		if t == ">" {
+			if n.rest == nil {
+				n.rest = make(map[uint16]struct{})
+			}
+			n.rest[id] = struct{}{}
+			return
+		}
+		c, ok := n.children[t]
+		if !ok {
+			c = newTopicNode()
+			n.children[t] = c
+		}
+		n = c
+	}
+	if n.members == nil {
+		n.members = make(map[uint16]struct{})
+	}
+	n.members[id] = struct{}{}
+}
+
+//remove 移除订阅，删除空的节点。
+func (tt *topicTrie) remove(pattern string, id uint16) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+	tt.root.remove(strings.Split(pattern, "."), id)
+}
+
+func (n *topicNode) remove(tokens []string, id uint16) {
+	switch {
+	case len(tokens) == 0:
+		delete(n.members, id)
+	case tokens[0] == ">":
+		delete(n.rest, id)
+	default:
+		if c, ok := n.children[tokens[0]]; ok {
+			c.remove(tokens[1:], id)
+			if len(c.children) == 0 && len(c.members) == 0 && len(c.rest) == 0 {
+				delete(n.children, tokens[0])
+			}
+		}
+	}
+}
+
+//match 订阅了与主题匹配的节点
+func (tt *topicTrie) match(topic string) []uint16 {
+	tt.mutex.RLock()
+	defer tt.mutex.RUnlock()
+	set := make(map[uint16]struct{}, 8)
+	tt.root.match(strings.Split(topic, "."), set)
+	ids := make([]uint16, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (n *topicNode) match(tokens []string, set map[uint16]struct{}) {
+	if len(tokens) == 0 {
+		for id := range n.members {
+			set[id] = struct{}{}
+		}
+		return
+	}
+	for id := range n.rest {
+		set[id] = struct{}{}
+	}
+	if c, ok := n.children[tokens[0]]; ok {
+		c.match(tokens[1:], set)
+	}
+	if c, ok := n.children["*"]; ok {
+		c.match(tokens[1:], set)
+	}
+}
+
+type topicMsg struct {
+	id        uint16
+	topic     string
+	operation uint16
+}
+
+//valueTOTopicMsg 由值解码
+func valueTOTopicMsg(b []byte) topicMsg {
+	var tm topicMsg
+	if len(b) < 2 {
+		return tm
+	}
+	tm.id = util.BytesToUint16(b[:2])
+	tm.topic = string(b[2:])
+	return tm
+}
+
+//keyTOTopicMsg 由键解码
+func keyTOTopicMsg(b []byte) topicMsg {
+	b = b[len(topicPrefix):]
+	if len(b) > 0 && b[len(b)-1] == '/' {
+		b = b[:len(b)-1]
+	}
+	return valueTOTopicMsg(b)
+}
+
+//SetTopic 订阅主题 operation 3 订阅 4 退订
+func (c *cluster) SetTopic(id uint16, topic string, operation uint16) {
+	var tm topicMsg
+	tm.id = id
+	tm.topic = topic
+	tm.operation = operation
+	c.TopicChan <- tm
+}
+
+//putTopic 写入、删除注册中心的订阅
+func (c *cluster) putTopic(tm topicMsg) {
+	key := make([]byte, len(topicPrefix)+2+len(tm.topic)+1)
+	copy(key, topicPrefix)
+	l := len(topicPrefix)
+	util.CopyUint16(key[l:l+2], tm.id)
+	copy(key[l+2:], tm.topic)
+	key[len(key)-1] = '/'
+	var err error
+	if tm.operation == 3 {
+		err = c.PutKey(context.TODO(), string(key), string(key[l:len(key)-1]))
+	} else {
+		err = c.DeleteKey(context.TODO(), string(key))
+	}
+	if err != nil {
+		c.Logger.Error("putTopic|", err.Error())
+	}
+}
+
+//AskTopic 发往所有订阅了与主题匹配的节点，每个节点一份，返回尝试发送的节点数。
+func (c *cluster) AskTopic(topic string, fs transport.FrameSlice, errFunc func(error)) int {
+	ids := c.topics.match(topic)
+	count := 0
+	for _, id := range ids {
+		m := (*transport.SessionTCP)(atomic.LoadPointer(&c.sessions[id]))
+		if m != nil {
+			count++
+			if err := m.WriteFrameDataToCache(fs, errFunc); err != nil {
+				errFunc(err)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		errFunc(fmt.Errorf("AskTopic|未发现订阅主题 %s 的节点", topic))
+	}
+	return count
+}
+
+//AskTopicOne 发往订阅了与主题匹配的某一个节点，随机选择，失败时尝试其它节点。返回发送的机器id，失败时返回-1。
+func (c *cluster) AskTopicOne(topic string, fs transport.FrameSlice, errFunc func(error)) int {
+	ids := c.topics.match(topic)
+	l := len(ids)
+	if l > 0 {
+		start := rand.Intn(l)
+		for i := 0; i < l; i++ {
+			id := ids[(start+i)%l]
+			m := (*transport.SessionTCP)(atomic.LoadPointer(&c.sessions[id]))
+			if m != nil {
+				if err := m.WriteFrameDataToCache(fs, errFunc); err == nil {
+					return int(id)
+				}
+			}
+		}
+	}
+	errFunc(fmt.Errorf("AskTopicOne|未发现订阅主题 %s 的节点", topic))
+	return -1
+}
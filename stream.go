@@ -0,0 +1,439 @@
+package domi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/duomi520/domi/transport"
+	"github.com/duomi520/domi/util"
+)
+
+//定义流的操作
+const (
+	streamOpen   uint8 = 1 + iota //打开，参数为频道
+	streamAccept                  //接受
+	streamData                    //数据
+	streamWindow                  //增加发送窗口，参数为增加的字节数
+	streamClose                   //半关闭，不再发送
+	streamReset                   //重置，数据为原因
+)
+
+//streamExtendLength 流扩展字段：2字节发起方机器id、8字节流id、1字节操作、4字节参数
+const streamExtendLength = 15
+
+//DefaultStreamWindow 流的接收窗口
+var DefaultStreamWindow = 256 * 1024
+
+//定义错误
+var (
+	ErrStreamReset    = errors.New("domi.Stream|流已被重置。")
+	ErrStreamClosed   = errors.New("domi.Stream|流已关闭发送。")
+	ErrStreamNoHandle = errors.New("domi.OpenStream|对端未注册流处理函数。")
+	ErrStreamPeerLost = errors.New("domi.Stream|对端节点已断开或已退订频道。")
+)
+
+type streamKey struct {
+	origin uint16 //发起方机器id
+	id     uint64
+}
+
+//streamTable 本节点的流
+type streamTable struct {
+	sequence uint64
+	mutex    sync.Mutex
+	streams  map[streamKey]*Stream
+	handlers map[uint16]func(*Stream)
+	runOnce  sync.Once
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{
+		streams:  make(map[streamKey]*Stream, 64),
+		handlers: make(map[uint16]func(*Stream), 16),
+	}
+}
+
+//Stream 节点间的双向流，与普通帧共用会话。Send、Recv可分别在不同协程中调用，但不可多个协程同时Send或同时Recv。
+type Stream struct {
+	n       *Node
+	key     streamKey
+	channel uint16
+	peer    uint16
+
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	accepted   chan struct{}
+	queue      [][]byte //已收到未读取的数据
+	queued     int      //queue中的字节数
+	consumed   int      //已读取未通知对端的字节数
+	sendWindow int      //可发送的字节数
+	recvClosed bool     //对端已半关闭
+	sendClosed bool     //本端已半关闭
+	err        error    //重置原因
+}
+
+func (n *Node) newStream(key streamKey, channel, peer uint16) *Stream {
+	st := &Stream{
+		n:          n,
+		key:        key,
+		channel:    channel,
+		peer:       peer,
+		accepted:   make(chan struct{}),
+		sendWindow: DefaultStreamWindow,
+	}
+	st.cond = sync.NewCond(&st.mutex)
+	return st
+}
+
+//HandleStream 注册频道的流处理函数，对端OpenStream时在新协程中调用f，f返回时关闭发送。
+//频道只用于流，不可再Subscribe，发往该频道的普通消息被丢弃并记录错误。
+func (n *Node) HandleStream(channel uint16, f func(*Stream)) {
+	if err := n.handleChannel(channel, n.streams, n.streamChannelWrapper); err != nil {
+		n.Logger.Error("HandleStream|", err.Error(), channel)
+		return
+	}
+	n.startStreams()
+	n.streams.mutex.Lock()
+	n.streams.handlers[channel] = f
+	n.streams.mutex.Unlock()
+	n.sidecar.SetChannel(uint16(n.sidecar.MachineID), channel, 3)
+}
+
+//streamChannelWrapper 流频道收到普通消息
+func (n *Node) streamChannelWrapper(s transport.Session) error {
+	n.Logger.Error("streamChannelWrapper|流频道不处理普通消息：", s.GetFrameSlice().GetFrameType())
+	return nil
+}
+
+//OpenStream 与订阅频道的某一节点打开流，阻塞至对端接受，或ctx超时、取消。
+func (n *Node) OpenStream(ctx context.Context, channel uint16) (*Stream, error) {
+	n.startStreams()
+	key := streamKey{origin: uint16(n.sidecar.MachineID), id: atomic.AddUint64(&n.streams.sequence, 1)}
+	st := n.newStream(key, channel, 0)
+	n.streams.mutex.Lock()
+	n.streams.streams[key] = st
+	n.streams.mutex.Unlock()
+	fs := transport.NewFrameSlice(transport.FrameTypeStream, nil, st.extend(streamOpen, uint32(channel)))
+	to := n.sidecar.AskOne(channel, fs, func(err error) {
+		st.reset(err, false)
+	})
+	if to < 0 {
+		err := errors.New("domi.OpenStream|发送失败。")
+		st.reset(err, false)
+		return nil, err
+	}
+	st.mutex.Lock()
+	st.peer = uint16(to)
+	st.mutex.Unlock()
+	select {
+	case <-st.accepted:
+		st.mutex.Lock()
+		err := st.err
+		st.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-ctx.Done():
+		st.reset(ctx.Err(), true)
+		return nil, ctx.Err()
+	}
+}
+
+//startStreams 节点关闭时重置所有流；对端失联，或本端打开的流的对端退订频道时重置相应的流。
+func (n *Node) startStreams() {
+	n.streams.runOnce.Do(func() {
+		n.sidecar.OnPeerLost(func(id uint16) {
+			go n.resetStreams(ErrStreamPeerLost, func(st *Stream) bool {
+				return st.Peer() == id
+			})
+		})
+		n.sidecar.OnChannelLeft(func(id, channel uint16) {
+			go n.resetStreams(ErrStreamPeerLost, func(st *Stream) bool {
+				return st.key.origin == uint16(n.sidecar.MachineID) && st.channel == channel && st.Peer() == id
+			})
+		})
+		go func() {
+			<-n.Ctx.Done()
+			n.resetStreams(ErrRequestClosed, func(*Stream) bool { return true })
+		}()
+	})
+}
+
+//resetStreams 重置符合条件的流，不通知对端。
+func (n *Node) resetStreams(err error, match func(*Stream) bool) {
+	n.streams.mutex.Lock()
+	streams := make([]*Stream, 0, len(n.streams.streams))
+	for _, st := range n.streams.streams {
+		streams = append(streams, st)
+	}
+	n.streams.mutex.Unlock()
+	for _, st := range streams {
+		if match(st) {
+			st.reset(err, false)
+		}
+	}
+}
+
+//extend 编码扩展字段
+func (st *Stream) extend(op uint8, arg uint32) []byte {
+	v := make([]byte, streamExtendLength)
+	util.CopyUint16(v[:2], st.key.origin)
+	util.CopyInt64(v[2:10], int64(st.key.id))
+	v[10] = op
+	util.CopyUint32(v[11:15], arg)
+	return appendExtend(nil, extendStream, v)
+}
+
+//send 发往对端，失败时重置流。
+func (st *Stream) send(op uint8, arg uint32, data []byte) {
+	fs := transport.NewFrameSlice(transport.FrameTypeStream, data, st.extend(op, arg))
+	st.n.sidecar.Specify(st.Peer(), transport.FrameTypeStream, fs, func(err error) {
+		st.reset(err, false)
+	})
+}
+
+//maxStreamChunk 每帧最多携带的数据，整帧需小于BytesPoolLenght，以使用发送缓存。
+func maxStreamChunk() int {
+	return transport.BytesPoolLenght - transport.FrameHeadLength - 2 - streamExtendLength - 1
+}
+
+//Send 发送，数据超过单帧大小时分为多帧，发送窗口不足时阻塞。
+func (st *Stream) Send(data []byte) error {
+	chunk := maxStreamChunk()
+	if chunk > DefaultStreamWindow {
+		chunk = DefaultStreamWindow
+	}
+	for {
+		l := len(data)
+		if l > chunk {
+			l = chunk
+		}
+		st.mutex.Lock()
+		for st.err == nil && !st.sendClosed && st.sendWindow < l {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			err := st.err
+			st.mutex.Unlock()
+			return err
+		}
+		if st.sendClosed {
+			st.mutex.Unlock()
+			return ErrStreamClosed
+		}
+		st.sendWindow -= l
+		st.mutex.Unlock()
+		st.send(streamData, 0, data[:l])
+		data = data[l:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+//Recv 接收一帧的数据，阻塞至收到数据；对端半关闭且数据已读完时返回io.EOF。
+func (st *Stream) Recv() ([]byte, error) {
+	st.mutex.Lock()
+	for len(st.queue) == 0 && !st.recvClosed && st.err == nil {
+		st.cond.Wait()
+	}
+	if len(st.queue) == 0 {
+		err := st.err
+		st.mutex.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	data := st.queue[0]
+	st.queue[0] = nil
+	st.queue = st.queue[1:]
+	st.queued -= len(data)
+	st.consumed += len(data)
+	var update int
+	//读取超过半个窗口时通知对端
+	if st.consumed >= DefaultStreamWindow/2 && !st.recvClosed {
+		update = st.consumed
+		st.consumed = 0
+	}
+	st.mutex.Unlock()
+	if update > 0 {
+		st.send(streamWindow, uint32(update), nil)
+	}
+	return data, nil
+}
+
+//CloseSend 半关闭，通知对端不再发送，仍可接收。
+func (st *Stream) CloseSend() {
+	st.mutex.Lock()
+	if st.sendClosed || st.err != nil {
+		st.mutex.Unlock()
+		return
+	}
+	st.sendClosed = true
+	done := st.recvClosed
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+	st.send(streamClose, 0, nil)
+	if done {
+		st.n.removeStream(st.key)
+	}
+}
+
+//Close 重置流，双方未完成的Send、Recv返回ErrStreamReset。
+func (st *Stream) Close() {
+	st.reset(ErrStreamReset, true)
+}
+
+//reset 重置，notify为true时通知对端。
+func (st *Stream) reset(err error, notify bool) {
+	st.mutex.Lock()
+	if st.err != nil {
+		st.mutex.Unlock()
+		return
+	}
+	st.err = err
+	st.queue = nil
+	st.cond.Broadcast()
+	select {
+	case <-st.accepted:
+	default:
+		close(st.accepted)
+	}
+	st.mutex.Unlock()
+	if notify {
+		reason := err.Error()
+		if len(reason) > 255 {
+			reason = reason[:255]
+		}
+		st.send(streamReset, 0, []byte(reason))
+	}
+	st.n.removeStream(st.key)
+}
+
+//ID 流id，与发起方机器id共同标识一个流。
+func (st *Stream) ID() (origin uint16, id uint64) {
+	return st.key.origin, st.key.id
+}
+
+//Peer 对端机器id
+func (st *Stream) Peer() uint16 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.peer
+}
+
+//Channel 打开流时的频道
+func (st *Stream) Channel() uint16 {
+	return st.channel
+}
+
+func (n *Node) removeStream(key streamKey) {
+	n.streams.mutex.Lock()
+	delete(n.streams.streams, key)
+	n.streams.mutex.Unlock()
+}
+
+//streamWrapper 处理流的帧，在读协程中调用，不可阻塞。
+func (n *Node) streamWrapper(s transport.Session) error {
+	fs := s.GetFrameSlice()
+	v := getExtend(fs.GetExtend(), extendStream)
+	if len(v) != streamExtendLength {
+		return errors.New("streamWrapper|流扩展字段错误。")
+	}
+	key := streamKey{origin: util.BytesToUint16(v[:2]), id: uint64(util.BytesToInt64(v[2:10]))}
+	op, arg := v[10], util.BytesToUint32(v[11:15])
+	if op == streamOpen {
+		n.acceptStream(key, uint16(arg))
+		return nil
+	}
+	n.streams.mutex.Lock()
+	st := n.streams.streams[key]
+	n.streams.mutex.Unlock()
+	if st == nil {
+		return nil
+	}
+	switch op {
+	case streamAccept:
+		st.mutex.Lock()
+		select {
+		case <-st.accepted:
+		default:
+			close(st.accepted)
+		}
+		st.mutex.Unlock()
+	case streamData:
+		fd := fs.GetData()
+		data := make([]byte, len(fd))
+		copy(data, fd)
+		st.mutex.Lock()
+		if st.err != nil || st.recvClosed {
+			st.mutex.Unlock()
+			return nil
+		}
+		if st.queued+len(data) > DefaultStreamWindow {
+			st.mutex.Unlock()
+			st.reset(errors.New("domi.Stream|对端超出接收窗口。"), true)
+			return nil
+		}
+		st.queue = append(st.queue, data)
+		st.queued += len(data)
+		st.cond.Broadcast()
+		st.mutex.Unlock()
+	case streamWindow:
+		st.mutex.Lock()
+		st.sendWindow += int(arg)
+		st.cond.Broadcast()
+		st.mutex.Unlock()
+	case streamClose:
+		st.mutex.Lock()
+		st.recvClosed = true
+		done := st.sendClosed
+		st.cond.Broadcast()
+		st.mutex.Unlock()
+		if done {
+			n.removeStream(key)
+		}
+	case streamReset:
+		reason := string(fs.GetData())
+		err := ErrStreamReset
+		if reason == ErrStreamNoHandle.Error() {
+			err = ErrStreamNoHandle
+		}
+		st.reset(err, false)
+	}
+	return nil
+}
+
+//acceptStream 对端打开流，调用频道的流处理函数。
+func (n *Node) acceptStream(key streamKey, channel uint16) {
+	st := n.newStream(key, channel, key.origin)
+	close(st.accepted)
+	n.streams.mutex.Lock()
+	f, ok := n.streams.handlers[channel]
+	if ok {
+		n.streams.streams[key] = st
+	}
+	n.streams.mutex.Unlock()
+	if !ok {
+		st.send(streamReset, 0, []byte(ErrStreamNoHandle.Error()))
+		return
+	}
+	st.send(streamAccept, 0, nil)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				n.Logger.Error("acceptStream|异常拦截：", r, string(debug.Stack()))
+				st.Close()
+				return
+			}
+			st.CloseSend()
+		}()
+		f(st)
+	}()
+}
@@ -0,0 +1,83 @@
+package domi
+
+import (
+	"sync"
+
+	"github.com/duomi520/domi/sidecar"
+	"github.com/duomi520/domi/transport"
+)
+
+//topicTable 本节点订阅的主题
+type topicTable struct {
+	mutex    sync.RWMutex
+	handlers map[string]processWrapper
+}
+
+func newTopicTable() *topicTable {
+	return &topicTable{
+		handlers: make(map[string]processWrapper, 16),
+	}
+}
+
+//SubscribeTopic 订阅主题，主题由'.'分隔，如 chat.room.42.msg，可使用通配符：'*'匹配一段，'>'匹配之后的一段或多段。
+//同一主题重复订阅时替换处理函数；消息与本节点订阅的多个主题匹配时，每个处理函数各调用一次。
+func (n *Node) SubscribeTopic(pattern string, f func(*ContextMQ)) error {
+	if err := sidecar.ValidTopic(pattern, true); err != nil {
+		return err
+	}
+	n.topics.mutex.Lock()
+	n.topics.handlers[pattern] = processWrapper{n: n, f: f}
+	n.topics.mutex.Unlock()
+	n.sidecar.SetTopic(uint16(n.sidecar.MachineID), pattern, 3)
+	return nil
+}
+
+//UnsubscribeTopic 退订主题
+func (n *Node) UnsubscribeTopic(pattern string) {
+	n.topics.mutex.Lock()
+	delete(n.topics.handlers, pattern)
+	n.topics.mutex.Unlock()
+	n.sidecar.SetTopic(uint16(n.sidecar.MachineID), pattern, 4)
+}
+
+//PublishTopic 发布主题，通知所有订阅了匹配主题的节点，每个节点一份。
+func (n *Node) PublishTopic(topic string, data []byte, reject func(error)) {
+	if err := sidecar.ValidTopic(topic, false); err != nil {
+		reject(err)
+		return
+	}
+	fs := transport.NewFrameSlice(transport.FrameTypeTopic, data, appendExtend(nil, extendTopic, []byte(topic)))
+	n.sidecar.AskTopic(topic, fs, reject)
+}
+
+//NotifyTopic 不回复请求，发往订阅了匹配主题的某一个节点。
+func (n *Node) NotifyTopic(topic string, data []byte, reject func(error)) {
+	if err := sidecar.ValidTopic(topic, false); err != nil {
+		reject(err)
+		return
+	}
+	fs := transport.NewFrameSlice(transport.FrameTypeTopic, data, appendExtend(nil, extendTopic, []byte(topic)))
+	n.sidecar.AskTopicOne(topic, fs, reject)
+}
+
+//topicWrapper 按主题交给本节点匹配的处理函数
+func (n *Node) topicWrapper(s transport.Session) error {
+	topic := string(getExtend(s.GetFrameSlice().GetExtend(), extendTopic))
+	n.topics.mutex.RLock()
+	matched := make([]processWrapper, 0, 2)
+	for pattern, pw := range n.topics.handlers {
+		if sidecar.MatchTopic(pattern, topic) {
+			matched = append(matched, pw)
+		}
+	}
+	n.topics.mutex.RUnlock()
+	for _, pw := range matched {
+		pw.processWrapper(s)
+	}
+	return nil
+}
+
+//Topic 主题，PublishTopic、NotifyTopic以外发送的请求为空。
+func (c *ContextMQ) Topic() string {
+	return string(getExtend(c.ex, extendTopic))
+}
@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/duomi520/domi/util"
+)
+
+/*
+握手（协议头之后，使用集群共享密钥的HMAC挑战/应答）
+  客户端 -> 服务端  hello	 [机器id 2][租约id 8][随机数Nc 32]
+  服务端 -> 客户端  challenge [机器id 2][租约id 8][随机数Ns 32][HMAC 32]
+  客户端 -> 服务端  response  [HMAC 32]
+双方均校验对端的HMAC及对端声明的机器id与租约id，失败即断开连接。
+*/
+
+const (
+	authNonceLength = 32
+	authMACLength   = sha256.Size
+	authHelloLength = 10 + authNonceLength
+)
+
+//定义错误
+var (
+	ErrAuthFailure = errors.New("transport.Authenticator|握手认证失败。")
+)
+
+//Authenticator 连接认证
+type Authenticator struct {
+	Secret    []byte                             //集群共享密钥
+	MachineID uint16                             //本节点机器id
+	LeaseID   int64                              //本节点租约id
+	Verify    func(id uint16, lease int64) error //校验对端声明的机器id及租约id
+}
+
+//mac 计算认证码 role区分服务端与客户端，防止反射攻击。
+func (a *Authenticator) mac(role byte, local, remote []byte) []byte {
+	h := hmac.New(sha256.New, a.Secret)
+	h.Write([]byte{role})
+	h.Write(local)
+	h.Write(remote)
+	return h.Sum(nil)
+}
+
+//hello 编码本节点身份及随机数
+func (a *Authenticator) hello() ([]byte, error) {
+	b := make([]byte, authHelloLength)
+	util.CopyUint16(b[:2], a.MachineID)
+	util.CopyInt64(b[2:10], a.LeaseID)
+	if _, err := rand.Read(b[10:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+//verifyHello 校验对端声明的身份
+func (a *Authenticator) verifyHello(b []byte) (uint16, error) {
+	id := util.BytesToUint16(b[:2])
+	if a.Verify != nil {
+		if err := a.Verify(id, util.BytesToInt64(b[2:10])); err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+//serverHandshake 服务端握手，返回对端机器id
+func (a *Authenticator) serverHandshake(conn net.Conn) (uint16, error) {
+	if err := conn.SetDeadline(time.Now().Add(SessionInternalTimeout)); err != nil {
+		return 0, err
+	}
+	defer conn.SetDeadline(time.Time{})
+	remote := make([]byte, authHelloLength)
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return 0, err
+	}
+	local, err := a.hello()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(append(local, a.mac('S', local, remote)...)); err != nil {
+		return 0, err
+	}
+	response := make([]byte, authMACLength)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return 0, err
+	}
+	if !hmac.Equal(response, a.mac('C', remote, local)) {
+		return 0, ErrAuthFailure
+	}
+	return a.verifyHello(remote)
+}
+
+//clientHandshake 客户端握手，返回对端机器id
+func (a *Authenticator) clientHandshake(conn net.Conn) (uint16, error) {
+	if err := conn.SetDeadline(time.Now().Add(SessionInternalTimeout)); err != nil {
+		return 0, err
+	}
+	defer conn.SetDeadline(time.Time{})
+	local, err := a.hello()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(local); err != nil {
+		return 0, err
+	}
+	challenge := make([]byte, authHelloLength+authMACLength)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return 0, err
+	}
+	remote := challenge[:authHelloLength]
+	if !hmac.Equal(challenge[authHelloLength:], a.mac('S', remote, local)) {
+		return 0, ErrAuthFailure
+	}
+	id, err := a.verifyHello(remote)
+	if err != nil {
+		return id, err
+	}
+	if _, err := conn.Write(a.mac('C', local, remote)); err != nil {
+		return id, err
+	}
+	return id, nil
+}
@@ -29,6 +29,10 @@ const (
 	FrameType8
 	FrameType9
 	FrameTypeNodeName
+	FrameTypeReply  //Request的回复
+	FrameTypeAck    //可靠投递的确认
+	FrameTypeTopic  //主题消息
+	FrameTypeStream //流
 )
 
 //定义
@@ -60,6 +60,7 @@ func (h *Handler) HandleFunc(u16 uint16, f func(Session) error) {
 
 //route 帧处理器函数路由
 func (h *Handler) route(ft uint16, s Session) error {
+	metricFramesIn.Inc()
 	f := atomic.LoadPointer(&h.frameWorker[ft])
 	if f != nil {
 		t := (*(*func(Session) error)(f))
@@ -2,6 +2,7 @@
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -16,7 +17,7 @@ import (
 //ClientTCP 客户端
 type ClientTCP struct {
 	Ctx     context.Context
-	conn    *net.TCPConn
+	conn    net.Conn
 	URL     string
 	limiter *util.Limiter //限流器
 	handler *Handler
@@ -26,7 +27,7 @@ type ClientTCP struct {
 }
 
 //NewClientTCP 新建
-func NewClientTCP(ctx context.Context, url string, h *Handler, sd *util.Dispatcher, limiter *util.Limiter, cbc *util.CircuitBreakerConfigure) (*ClientTCP, error) {
+func NewClientTCP(ctx context.Context, url string, h *Handler, sd *util.Dispatcher, limiter *util.Limiter, cbc *util.CircuitBreakerConfigure, sc *SecurityConfigure) (*ClientTCP, error) {
 	logger, _ := util.NewLogger(util.ErrorLevel, "")
 	if h == nil {
 		return nil, errors.New("NewClientTCP|Handler不为nil。")
@@ -35,13 +36,22 @@ func NewClientTCP(ctx context.Context, url string, h *Handler, sd *util.Dispatch
 	if err != nil {
 		return nil, errors.New("NewClientTCP|tcpAddr失败:" + err.Error())
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
 	if err != nil {
 		return nil, errors.New("NewClientTCP|连接服务端失败:" + err.Error())
 	}
-	if conn.SetNoDelay(false) != nil {
+	if err = tcpConn.SetNoDelay(false); err != nil {
+		tcpConn.Close()
 		return nil, errors.New("NewClientTCP|设定操作系统是否应该延迟数据包传递失败:" + err.Error())
 	}
+	var conn net.Conn = tcpConn
+	//TLS握手
+	if sc.tlsEnabled() {
+		if conn, err = tlsHandshake(tls.Client(tcpConn, sc.clientConfig())); err != nil {
+			tcpConn.Close()
+			return nil, errors.New("NewClientTCP|TLS握手失败:" + err.Error())
+		}
+	}
 	c := &ClientTCP{
 		Ctx:     ctx,
 		conn:    conn,
@@ -67,6 +77,17 @@ func NewClientTCP(ctx context.Context, url string, h *Handler, sd *util.Dispatch
 	return c, nil
 }
 
+//Handshake 握手认证，需在Run之前执行。
+func (c *ClientTCP) Handshake(a *Authenticator) error {
+	id, err := a.clientHandshake(c.conn)
+	if err != nil {
+		return fmt.Errorf("Handshake|握手认证失败:%s id:%d err:%s", c.URL, id, err.Error())
+	}
+	c.Csession.peerID = id
+	c.Csession.authenticated = true
+	return nil
+}
+
 //Heartbeat 写入心跳包
 func (c *ClientTCP) Heartbeat() error {
 	if err := c.Csession.WriteFrameDataPromptly(FrameHeartbeatS); err != nil {
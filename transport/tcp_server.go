@@ -2,6 +2,7 @@
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"runtime"
@@ -21,13 +22,15 @@ type ServerTCP struct {
 	tcpListener                   *net.TCPListener
 	tcpPost                       string //端口号
 	handler                       *Handler
+	security                      *SecurityConfigure //安全配置
+	Authenticator                 *Authenticator     //连接认证，nil时不认证
 	Logger                        *util.Logger
 	*util.CircuitBreakerConfigure //熔断器配置
 	util.WaitGroupWrapper
 }
 
 //NewServerTCP 新建
-func NewServerTCP(ctx context.Context, post string, h *Handler, sd *util.Dispatcher, limiter *util.Limiter, cbc *util.CircuitBreakerConfigure) *ServerTCP {
+func NewServerTCP(ctx context.Context, post string, h *Handler, sd *util.Dispatcher, limiter *util.Limiter, cbc *util.CircuitBreakerConfigure, sc *SecurityConfigure) *ServerTCP {
 	logger, _ := util.NewLogger(util.ErrorLevel, "")
 	logger.SetMark("ServerTCP")
 	if h == nil {
@@ -47,6 +50,7 @@ func NewServerTCP(ctx context.Context, post string, h *Handler, sd *util.Dispatc
 		tcpPost:     post,
 		limiter:     limiter,
 		handler:     h,
+		security:    sc,
 		Logger:      logger,
 	}
 	s.CircuitBreakerConfigure = cbc
@@ -98,12 +102,22 @@ func (s *ServerTCP) Run() {
 }
 
 //tcpReceive 接收
-func tcpReceive(s *ServerTCP, conn *net.TCPConn) {
+func tcpReceive(s *ServerTCP, conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
 			s.Logger.Error("tcpReceive|defer错误：", r, string(debug.Stack()))
 		}
 	}()
+	//TLS握手
+	if s.security.tlsEnabled() {
+		tlsConn, err := tlsHandshake(tls.Server(conn, s.security.serverConfig()))
+		if err != nil {
+			s.Logger.Warn("tcpReceive|TLS握手失败:", conn.RemoteAddr(), " err:", err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
 	session := NewSessionTCP(conn, s.handler, s.CircuitBreakerConfigure)
 	session.dispatcher = s.dispatcher
 	s.Add(1)
@@ -121,6 +135,16 @@ func tcpReceive(s *ServerTCP, conn *net.TCPConn) {
 		s.Logger.Warn("tcpReceive|警告: 无效的协议头。")
 		return
 	}
+	//握手认证
+	if s.Authenticator != nil {
+		id, err := s.Authenticator.serverHandshake(conn)
+		if err != nil {
+			s.Logger.Error("tcpReceive|握手认证失败:", conn.RemoteAddr(), " id:", id, " err:", err)
+			return
+		}
+		session.peerID = id
+		session.authenticated = true
+	}
 	err = s.ioLoop(session)
 	if err != nil && err != io.EOF {
 		if !strings.Contains(err.Error(), "wsarecv: An existing connection was forcibly closed by the remote host.") {
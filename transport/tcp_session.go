@@ -2,6 +2,7 @@ package transport
 
 import (
 	"errors"
+	"io"
 	"net"
 	"runtime"
 	"sync"
@@ -20,6 +21,9 @@ var BytesPoolLenght32 uint32 = 32768
 //SessionInternalTimeout 内部超时
 var SessionInternalTimeout = DefaultDeadlineDuration
 
+//SessionBacklog 会话中等待前序发送的任务数上限，对端过慢超出时WriteFrameDataToCache返回ErrFailureBusy。
+var SessionBacklog int32 = 64
+
 //池
 var bytesPool sync.Pool
 var rejectPool sync.Pool
@@ -53,15 +57,34 @@ var (
 	ErrAvailableCursor      = errors.New("transport.SessionTCP.WorkFunc|availableCursor异常。")
 )
 
+//定义指标
+var (
+	metricFramesIn        = util.DefaultMetrics.NewCounter("domi_transport_frames_received_total", "Number of frames received.", "")
+	metricFramesOut       = util.DefaultMetrics.NewCounter("domi_transport_frames_sent_total", "Number of frames queued or written for sending.", "")
+	metricBytesIn         = util.DefaultMetrics.NewCounter("domi_transport_bytes_received_total", "Number of bytes read from connections.", "")
+	metricBytesOut        = util.DefaultMetrics.NewCounter("domi_transport_bytes_sent_total", "Number of bytes written to connections.", "")
+	metricBusy            = util.DefaultMetrics.NewCounter("domi_transport_busy_rejections_total", "Number of frames rejected with ErrFailureBusy.", "")
+	metricInternalTimeout = util.DefaultMetrics.NewCounter("domi_transport_internal_timeouts_total", "Number of frames rejected with ErrInternalTimeout.", "")
+	metricCircuitBreaker  = util.DefaultMetrics.NewCounter("domi_transport_circuit_breaker_rejections_total", "Number of frames rejected by an open circuit breaker.", "")
+)
+
 //SessionTCP 会话
 type SessionTCP struct {
-	Conn           *net.TCPConn
+	orderMutex sync.Mutex
+	sentTicket uint64            //已发送的最大序号
+	ordered    map[uint64]sender //未轮到发送的任务，按序号由前一任务的工作者接续发送。
+	backlog    int32             //ordered的长度	原子操作
+
+	Conn           net.Conn
 	dispatcher     *util.Dispatcher
 	handler        *Handler
 	circuitBreaker *util.CircuitBreaker //熔断器
 
 	state uint32
 
+	peerID        uint16 //握手认证后对端的机器id
+	authenticated bool   //是否已通过握手认证
+
 	rBuf []byte //IO读缓存
 	w    int    //rBuf 读位置序号
 	r    int    //rBuf 写位置序号
@@ -73,7 +96,7 @@ type SessionTCP struct {
 }
 
 //NewSessionTCP 新建
-func NewSessionTCP(conn *net.TCPConn, h *Handler, cbc *util.CircuitBreakerConfigure) *SessionTCP {
+func NewSessionTCP(conn net.Conn, h *Handler, cbc *util.CircuitBreakerConfigure) *SessionTCP {
 	s := &SessionTCP{
 		Conn:    conn,
 		handler: h,
@@ -81,8 +104,10 @@ func NewSessionTCP(conn *net.TCPConn, h *Handler, cbc *util.CircuitBreakerConfig
 		rBuf:    bytesPool.Get().([]byte),
 		r:       0,
 		w:       0,
+		ordered: make(map[uint64]sender, 8),
 	}
 	ws := newSlot(s)
+	ws.ticket = 1
 	s.wSlot = unsafe.Pointer(&ws)
 	//配置熔断器
 	s.circuitBreaker = util.NewCircuitBreaker(cbc)
@@ -154,6 +179,7 @@ func (s *SessionTCP) ioRead() (int, error) {
 		return 0, err
 	}
 	n, err := s.Conn.Read(s.rBuf[s.w:])
+	metricBytesIn.Add(uint64(n))
 	s.r = 0
 	s.w += n
 	return s.w - s.r, err
@@ -169,7 +195,10 @@ func (s *SessionTCP) WriteFrameDataPromptly(f FrameSlice) error {
 		if err = s.Conn.SetWriteDeadline(time.Now().Add(SessionInternalTimeout)); err != nil {
 			return err
 		}
-		_, err = s.Conn.Write(f.base)
+		var n int
+		n, err = s.Conn.Write(f.base)
+		metricBytesOut.Add(uint64(n))
+		metricFramesOut.Inc()
 	}
 	return err
 }
@@ -178,9 +207,15 @@ type simpleSlot struct {
 	session *SessionTCP
 	fs      FrameSlice
 	errFunc func(error)
+	ticket  uint64 //发送序号
 }
 
 func (ss simpleSlot) WorkFunc() {
+	ss.session.sendInTurn(ss.ticket, ss)
+}
+
+//send IO发送
+func (ss simpleSlot) send() {
 	if err := ss.session.WriteFrameDataPromptly(ss.fs); err != nil {
 		if ss.session.circuitBreaker != nil {
 			ss.session.circuitBreaker.ErrorRecord()
@@ -190,6 +225,65 @@ func (ss simpleSlot) WorkFunc() {
 	ss.session.Done()
 }
 
+/*
+发送顺序：每个slot及直接发送的帧有连续的发送序号，替换slot时新slot的序号为旧slot加1。
+未轮到的任务放入ordered后立即返回，不占用工作者；发送完成的工作者接续发送下一序号的任务，
+保证同一会话中的帧按写入缓存的顺序发送，且每个会话同时最多占用一个工作者写连接。
+*/
+
+//sender 按序号发送的任务
+type sender interface {
+	send()
+}
+
+//sendInTurn 轮到序号时发送，并接续发送之后已到达的任务，否则放入ordered等待。
+func (s *SessionTCP) sendInTurn(ticket uint64, j sender) {
+	s.orderMutex.Lock()
+	if s.sentTicket+1 != ticket {
+		s.ordered[ticket] = j
+		atomic.StoreInt32(&s.backlog, int32(len(s.ordered)))
+		s.orderMutex.Unlock()
+		return
+	}
+	s.orderMutex.Unlock()
+	for {
+		j.send()
+		s.orderMutex.Lock()
+		s.sentTicket = ticket
+		ticket++
+		next, ok := s.ordered[ticket]
+		if ok {
+			delete(s.ordered, ticket)
+			atomic.StoreInt32(&s.backlog, int32(len(s.ordered)))
+		}
+		s.orderMutex.Unlock()
+		if !ok {
+			return
+		}
+		j = next
+	}
+}
+
+//reserveTicket 以新的slot替换当前slot，返回两者之间的发送序号。
+func (s *SessionTCP) reserveTicket() uint64 {
+	for {
+		cur := (*slot)(atomic.LoadPointer(&s.wSlot))
+		ns := newSlot(s)
+		ns.ticket = cur.ticket + 2
+		if !atomic.CompareAndSwapPointer(&s.wSlot, unsafe.Pointer(cur), unsafe.Pointer(&ns)) {
+			ns.releaseNoClear()
+			continue
+		}
+		//使之后的写入越界，cur为空时无人提交，由本协程提交以保持序号连续。
+		if atomic.AddUint32(&cur.allotCursor, BytesPoolLenght32+1) == BytesPoolLenght32+1 {
+			s.Add(1)
+			cur.timestamp = time.Now()
+			s.dispatcher.JobQueue <- cur
+		}
+		return cur.ticket + 1
+	}
+}
+
 //WriteFrameDataToCache 写入发送缓存,由线程池异步发送
 func (s *SessionTCP) WriteFrameDataToCache(f FrameSlice, errFunc func(error)) error {
 	//会话已关闭
@@ -198,8 +292,17 @@ func (s *SessionTCP) WriteFrameDataToCache(f FrameSlice, errFunc func(error)) er
 	}
 	//熔断器开启状态
 	if s.circuitBreaker != nil && !s.circuitBreaker.IsPass() {
+		metricCircuitBreaker.Inc()
 		return ErrcircuitBreakerIsPass
 	}
+	//对端过慢，等待发送的任务过多
+	if atomic.LoadInt32(&s.backlog) >= SessionBacklog {
+		if s.circuitBreaker != nil {
+			s.circuitBreaker.ErrorRecord()
+		}
+		metricBusy.Inc()
+		return ErrFailureBusy
+	}
 	//超过缓存，直接发送
 	if f.GetFrameLength() >= BytesPoolLenght {
 		s.Add(1)
@@ -207,6 +310,7 @@ func (s *SessionTCP) WriteFrameDataToCache(f FrameSlice, errFunc func(error)) er
 			session: s,
 			fs:      f,
 			errFunc: errFunc,
+			ticket:  s.reserveTicket(),
 		}
 		s.dispatcher.JobQueue <- ss
 		return nil
@@ -227,6 +331,7 @@ loop:
 				if s.circuitBreaker != nil {
 					s.circuitBreaker.ErrorRecord()
 				}
+				metricBusy.Inc()
 				return ErrFailureBusy
 			}
 			busy++
@@ -236,6 +341,7 @@ loop:
 		}
 		//刚好越界触发
 		ns := newSlot(s)
+		ns.ticket = myslot.ticket + 1
 		if !atomic.CompareAndSwapPointer(&s.wSlot, unsafe.Pointer(myslot), unsafe.Pointer(&ns)) {
 			ns.releaseNoClear()
 		}
@@ -244,6 +350,7 @@ loop:
 		goto loop
 	}
 	f.WriteToBytes(myslot.buf[start:end])
+	metricFramesOut.Inc()
 	atomic.AddUint32(&myslot.availableCursor, length)
 	rc := atomic.AddUint32(&myslot.rejectCursor, 1)
 	myslot.rejects[rc] = errFunc
@@ -257,18 +364,37 @@ loop:
 	return nil
 }
 
+//GetPeer 取得握手认证后对端的机器id，未认证时ok为false。
+func (s *SessionTCP) GetPeer() (id uint16, ok bool) {
+	return s.peerID, s.authenticated
+}
+
 //SetState 设置状态
 func (s *SessionTCP) SetState(u uint32) {
 	atomic.StoreUint32(&s.state, u)
 }
 
+//GetState 读取状态
+func (s *SessionTCP) GetState() uint32 {
+	return atomic.LoadUint32(&s.state)
+}
+
+//GetCircuitBreakerState 读取熔断器状态，会话已释放时返回0。
+func (s *SessionTCP) GetCircuitBreakerState() uint32 {
+	cb := s.circuitBreaker
+	if cb == nil {
+		return 0
+	}
+	return cb.GetState()
+}
+
 //readUint32 读uint32
 func (s *SessionTCP) readUint32() (uint32, error) {
 	b := make([]byte, 4)
 	if err := s.Conn.SetReadDeadline(time.Now().Add(SessionInternalTimeout)); err != nil {
 		return 0, err
 	}
-	if _, err := s.Conn.Read(b); err != nil {
+	if _, err := io.ReadFull(s.Conn, b); err != nil {
 		return 0, err
 	}
 	i := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
@@ -281,6 +407,7 @@ type slot struct {
 	buf       []byte //IO写缓存
 	rejects   []func(error)
 	timestamp time.Time
+	ticket    uint64 //发送序号
 
 	_padding0       [8]uint64
 	allotCursor     uint32 //申请位置
@@ -314,7 +441,9 @@ func (ws *slot) releaseNoClear() {
 
 //WorkFunc 发送
 func (ws *slot) WorkFunc() {
-	ns := newSlot(ws.session)
+	s := ws.session
+	ns := newSlot(s)
+	ns.ticket = ws.ticket + 1
 	if !atomic.CompareAndSwapPointer(&ws.session.wSlot, unsafe.Pointer(ws), unsafe.Pointer(&ns)) {
 		ns.releaseNoClear()
 	}
@@ -326,20 +455,28 @@ func (ws *slot) WorkFunc() {
 	}
 	//返回内部调度超时错误
 	if time.Now().Sub(ws.timestamp) > SessionInternalTimeout {
+		metricInternalTimeout.Add(uint64(ws.rejectCursor))
 		ws.rejectsRange(ErrInternalTimeout)
 	}
-	//IO发送
+	s.sendInTurn(ws.ticket, ws)
+}
+
+//send IO发送
+func (ws *slot) send() {
+	s := ws.session
 	if ws.availableCursor >= uint32(FrameHeadLength) {
 		if err := ws.session.Conn.SetWriteDeadline(time.Now().Add(SessionInternalTimeout)); err != nil {
 			ws.rejectsRange(err)
 		}
-		if _, err := ws.session.Conn.Write(ws.buf[:ws.availableCursor]); err != nil {
+		n, err := ws.session.Conn.Write(ws.buf[:ws.availableCursor])
+		metricBytesOut.Add(uint64(n))
+		if err != nil {
 			ws.rejectsRange(err)
 		}
-	} else {
+	} else if ws.availableCursor > 0 {
 		ws.rejectsRange(ErrAvailableCursor)
 	}
-	ws.session.Done()
+	s.Done()
 	copy(ws.rejects[:ws.rejectCursor], nilRejects[:ws.rejectCursor])
 	ws.release()
 }
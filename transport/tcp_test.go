@@ -3,8 +3,18 @@ package transport
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -23,9 +33,9 @@ func Test_tcpServer(t *testing.T) {
 	go sd.Run()
 	ctx, ctxExitFunc := context.WithCancel(context.Background())
 	h := NewHandler()
-	s := NewServerTCP(ctx, ":4567", h, sd, nil, &cbc)
+	s := NewServerTCP(ctx, ":4567", h, sd, nil, &cbc, nil)
 	go s.Run()
-	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4567", h, sd, nil, &cbc)
+	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4567", h, sd, nil, &cbc, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -47,11 +57,11 @@ func Test_tcpServerPingPong(t *testing.T) {
 	loop2 := loop1 * 2
 	ctx, ctxExitFunc := context.WithCancel(context.Background())
 	h := NewHandler()
-	s := NewServerTCP(ctx, ":4568", h, sd, nil, &cbc)
+	s := NewServerTCP(ctx, ":4568", h, sd, nil, &cbc, nil)
 	go s.Run()
 	h.HandleFunc(55, testPingFunc55)
 	h.HandleFunc(56, testPingFunc56)
-	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4568", h, sd, nil, &cbc)
+	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4568", h, sd, nil, &cbc, nil)
 	h.HandleFunc(57, testPongFunc)
 	if err != nil {
 		t.Error(err)
@@ -117,6 +127,142 @@ func testPongFunc(s Session) error {
 	return nil
 }
 
+func Test_order(t *testing.T) {
+	cbc := util.NewCircuitBreakerConfigure()
+	sd := util.NewDispatcher(32)
+	defer sd.Close()
+	go sd.Run()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionTCP(c1, NewHandler(), &cbc)
+	s.dispatcher = sd
+	//缓存中的帧与直接发送的大帧交错
+	n := 5000
+	done := make(chan []uint32)
+	go func() {
+		done <- testReadFrames(c2, n)
+	}()
+	for i := 0; i < n; i++ {
+		size := 100
+		if i%500 == 0 {
+			size = BytesPoolLenght
+		}
+		data := make([]byte, size)
+		util.CopyUint32(data[:4], uint32(i))
+		for {
+			err := s.WriteFrameDataToCache(NewFrameSlice(58, data, nil), func(err error) { t.Error(err) })
+			if err == nil {
+				break
+			}
+			if err != ErrFailureBusy {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	received := <-done
+	if len(received) != n {
+		t.Fatal(len(received))
+	}
+	for i, v := range received {
+		if v != uint32(i) {
+			t.Fatal(i, v)
+		}
+	}
+	s.Close()
+}
+
+//testReadFrames 从连接读取n个帧，返回各帧数据的前4字节。
+func testReadFrames(c net.Conn, n int) []uint32 {
+	var received []uint32
+	head := make([]byte, FrameHeadLength)
+	for len(received) < n {
+		if _, err := io.ReadFull(c, head); err != nil {
+			break
+		}
+		body := make([]byte, int(util.BytesToUint32(head[:4]))-FrameHeadLength)
+		if _, err := io.ReadFull(c, body); err != nil {
+			break
+		}
+		received = append(received, util.BytesToUint32(body[:4]))
+	}
+	return received
+}
+
+func Test_slowPeer(t *testing.T) {
+	cbc := util.NewCircuitBreakerConfigure()
+	//工作者少于会话数
+	sd := util.NewDispatcher(2)
+	defer sd.Close()
+	go sd.Run()
+	write := func(s *SessionTCP, n int, large int) {
+		for i := 0; i < n; i++ {
+			size := 1000
+			if large > 0 && i%large == 0 {
+				size = BytesPoolLenght
+			}
+			data := make([]byte, size)
+			util.CopyUint32(data[:4], uint32(i))
+			for {
+				err := s.WriteFrameDataToCache(NewFrameSlice(58, data, nil), func(err error) { t.Error(err) })
+				if err == nil {
+					break
+				}
+				if err != ErrFailureBusy {
+					t.Error(err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	check := func(received []uint32, n int) {
+		if len(received) != n {
+			t.Fatal(len(received), n)
+		}
+		for i, v := range received {
+			if v != uint32(i) {
+				t.Fatal(i, v)
+			}
+		}
+	}
+	//慢的对端：在其它会话完成前不读取
+	slowConn, slowPeer := net.Pipe()
+	defer slowPeer.Close()
+	slow := NewSessionTCP(slowConn, NewHandler(), &cbc)
+	slow.dispatcher = sd
+	slowN := 300
+	go write(slow, slowN, 50)
+	time.Sleep(20 * time.Millisecond)
+	n := 2000
+	done := make(chan []uint32, 3)
+	var fast []*SessionTCP
+	for k := 0; k < 3; k++ {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		s := NewSessionTCP(c1, NewHandler(), &cbc)
+		s.dispatcher = sd
+		fast = append(fast, s)
+		go func() {
+			done <- testReadFrames(c2, n)
+		}()
+		go write(s, n, 0)
+	}
+	for k := 0; k < 3; k++ {
+		select {
+		case received := <-done:
+			check(received, n)
+		case <-time.After(3 * time.Second):
+			t.Fatal("慢的对端阻塞了其它会话的发送。")
+		}
+	}
+	check(testReadFrames(slowPeer, slowN), slowN)
+	for _, s := range fast {
+		s.Close()
+	}
+	slow.Close()
+}
+
 func Test_limiter(t *testing.T) {
 	cbc := util.NewCircuitBreakerConfigure()
 	var testLimiterWG sync.WaitGroup
@@ -139,9 +285,9 @@ func Test_limiter(t *testing.T) {
 		return nil
 	})
 	ctx, ctxExitFunc := context.WithCancel(context.Background())
-	s := NewServerTCP(ctx, ":4569", h, sd, limiter, &cbc)
+	s := NewServerTCP(ctx, ":4569", h, sd, limiter, &cbc, nil)
 	go s.Run()
-	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4569", h, sd, nil, &cbc)
+	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4569", h, sd, nil, &cbc, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,9 +316,9 @@ func Test_circuitBreaker(t *testing.T) {
 	h.HandleFunc(65, func(Session) error {
 		return nil
 	})
-	s := NewServerTCP(ctx, ":4570", h, sd, nil, &cbc)
+	s := NewServerTCP(ctx, ":4570", h, sd, nil, &cbc, nil)
 	go s.Run()
-	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4570", h, sd, nil, &cbc)
+	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4570", h, sd, nil, &cbc, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -194,3 +340,149 @@ func Test_circuitBreaker(t *testing.T) {
 	sd.Close()
 	time.Sleep(150 * time.Millisecond)
 }
+
+//testSecurityConfigure 临时生成自签名根证书及节点证书
+func testSecurityConfigure(t *testing.T) (*SecurityConfigure, *x509.CertPool) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "domi test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	nodeKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "domi test node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	nodeDER, err := x509.CreateCertificate(rand.Reader, nodeTemplate, caCert, &nodeKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &SecurityConfigure{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{nodeDER}, PrivateKey: nodeKey}},
+		RootCAs:      pool,
+		MutualTLS:    true,
+	}
+	return sc, pool
+}
+
+func Test_tls(t *testing.T) {
+	var count int32
+	sc, pool := testSecurityConfigure(t)
+	cbc := util.NewCircuitBreakerConfigure()
+	sd := util.NewDispatcher(64)
+	go sd.Run()
+	ctx, ctxExitFunc := context.WithCancel(context.Background())
+	h := NewHandler()
+	h.HandleFunc(66, func(Session) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	s := NewServerTCP(ctx, ":4571", h, sd, nil, &cbc, sc)
+	go s.Run()
+	c, err := NewClientTCP(context.TODO(), "127.0.0.1:4571", h, sd, nil, &cbc, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Run()
+	fs := NewFrameSlice(66, []byte("tls"), nil)
+	for i := 0; i < 10; i++ {
+		if err := c.Csession.WriteFrameDataPromptly(fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//未提供客户端证书的连接被拒绝
+	bad, err := NewClientTCP(context.TODO(), "127.0.0.1:4571", h, sd, nil, &cbc, &SecurityConfigure{RootCAs: pool})
+	if err == nil {
+		go bad.Run()
+		bad.Csession.WriteFrameDataPromptly(fs)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if atomic.LoadInt32(&count) != 10 {
+		t.Error("TLS传输失败:", atomic.LoadInt32(&count))
+	}
+	ctxExitFunc()
+	time.Sleep(150 * time.Millisecond)
+	c.Csession.Close()
+	if bad != nil {
+		bad.Csession.Close()
+	}
+	time.Sleep(150 * time.Millisecond)
+	sd.Close()
+	time.Sleep(150 * time.Millisecond)
+}
+
+func Test_handshake(t *testing.T) {
+	var count int32
+	secret := []byte("domi cluster secret")
+	verify := func(id uint16, lease int64) error {
+		if int64(id)*100 != lease {
+			return errors.New("租约不符")
+		}
+		return nil
+	}
+	cbc := util.NewCircuitBreakerConfigure()
+	sd := util.NewDispatcher(64)
+	go sd.Run()
+	ctx, ctxExitFunc := context.WithCancel(context.Background())
+	h := NewHandler()
+	h.HandleFunc(67, func(Session) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	s := NewServerTCP(ctx, ":4572", h, sd, nil, &cbc, nil)
+	s.Authenticator = &Authenticator{Secret: secret, MachineID: 1, LeaseID: 100, Verify: verify}
+	go s.Run()
+	fs := NewFrameSlice(67, []byte("auth"), nil)
+	dial := func(a *Authenticator) error {
+		c, err := NewClientTCP(context.TODO(), "127.0.0.1:4572", h, sd, nil, &cbc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Csession.Close()
+		if err := c.Handshake(a); err != nil {
+			return err
+		}
+		go c.Run()
+		c.Csession.WriteFrameDataPromptly(fs)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	if err := dial(&Authenticator{Secret: secret, MachineID: 2, LeaseID: 200, Verify: verify}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(&Authenticator{Secret: []byte("wrong"), MachineID: 3, LeaseID: 300, Verify: verify}); err == nil {
+		t.Error("错误的密钥通过认证。")
+	}
+	//冒充的机器id，由服务端拒绝。
+	dial(&Authenticator{Secret: secret, MachineID: 4, LeaseID: 200, Verify: verify})
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&count) != 1 {
+		t.Error("握手认证失败:", atomic.LoadInt32(&count))
+	}
+	ctxExitFunc()
+	time.Sleep(150 * time.Millisecond)
+	sd.Close()
+	time.Sleep(150 * time.Millisecond)
+}
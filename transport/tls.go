@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+//SecurityConfigure 安全配置，为nil时节点间使用明文传输且不认证。
+type SecurityConfigure struct {
+	Certificates []tls.Certificate //本节点证书，同时用于服务端及客户端
+	RootCAs      *x509.CertPool    //校验对端证书的根证书，为nil时使用系统根证书
+	ServerName   string            //客户端校验服务端证书的主机名，为空时只校验证书链
+	MutualTLS    bool              //双向认证，服务端要求并校验客户端证书
+	Secret       []byte            //集群共享密钥，非空时连接需通过HMAC握手认证
+}
+
+//LoadSecurityConfigure 从PEM文件读取证书、私钥及根证书。
+func LoadSecurityConfigure(certFile, keyFile, caFile string, mutual bool) (*SecurityConfigure, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New("LoadSecurityConfigure|读取证书失败:" + err.Error())
+	}
+	sc := &SecurityConfigure{
+		Certificates: []tls.Certificate{cert},
+		MutualTLS:    mutual,
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.New("LoadSecurityConfigure|读取根证书失败:" + err.Error())
+		}
+		sc.RootCAs = x509.NewCertPool()
+		if !sc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("LoadSecurityConfigure|根证书无效。")
+		}
+	}
+	return sc, nil
+}
+
+//tlsEnabled 是否启用TLS，仅配置共享密钥时只认证不加密。
+func (sc *SecurityConfigure) tlsEnabled() bool {
+	return sc != nil && (len(sc.Certificates) > 0 || sc.RootCAs != nil)
+}
+
+//serverConfig 服务端配置
+func (sc *SecurityConfigure) serverConfig() *tls.Config {
+	c := &tls.Config{
+		Certificates: sc.Certificates,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if sc.MutualTLS {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = sc.RootCAs
+	}
+	return c
+}
+
+//clientConfig 客户端配置
+func (sc *SecurityConfigure) clientConfig() *tls.Config {
+	c := &tls.Config{
+		Certificates: sc.Certificates,
+		RootCAs:      sc.RootCAs,
+		ServerName:   sc.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	//集群节点通过ip互连，未指定主机名时只校验证书链。
+	if sc.ServerName == "" {
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = sc.verifyChain
+	}
+	return c
+}
+
+//verifyChain 校验对端证书链，不校验主机名。
+func (sc *SecurityConfigure) verifyChain(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("verifyChain|对端未提供证书。")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.New("verifyChain|解析证书失败:" + err.Error())
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         sc.RootCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+//tlsHandshake 在conn上完成TLS握手
+func tlsHandshake(conn *tls.Conn) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(DefaultDeadlineDuration)); err != nil {
+		return nil, err
+	}
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -12,6 +12,9 @@ const (
 	rollingBucketTimeDivide uint64 = 20
 )
 
+//circuitBreakerTrips 熔断器开启次数
+var circuitBreakerTrips = DefaultMetrics.NewCounter("domi_circuit_breaker_trips_total", "Number of times circuit breakers opened.", "")
+
 //CircuitBreakerConfigure 熔断器配置 实现快速失败并走备用方案
 type CircuitBreakerConfigure struct {
 	RollingBucketsNum      uint64 //熔断器设置统计窗口的桶数量 默认2，每个桶的时间间隔约1*Millisecond
@@ -84,6 +87,7 @@ func (cb *CircuitBreaker) ErrorRecord() {
 		if 1 >= cb.RequestVolumeThreshold {
 			if atomic.CompareAndSwapUint32(&cb.state, StateCircuitBreakerClosed, StateCircuitBreakerOpen) {
 				atomic.StoreInt64(&cb.timestamp, time.Now().UnixNano())
+				circuitBreakerTrips.Inc()
 			}
 		}
 		return
@@ -115,6 +119,7 @@ func (cb *CircuitBreaker) ErrorRecord() {
 	if cb.buckets.item[len(cb.buckets.item)-1].total >= cb.RequestVolumeThreshold {
 		if atomic.CompareAndSwapUint32(&cb.state, StateCircuitBreakerClosed, StateCircuitBreakerOpen) {
 			atomic.StoreInt64(&cb.timestamp, time.Now().UnixNano())
+			circuitBreakerTrips.Inc()
 		}
 	}
 }
@@ -136,6 +141,14 @@ func (cb *CircuitBreaker) IsPass() bool {
 	return false
 }
 
+//GetState 读取状态
+func (cb *CircuitBreaker) GetState() uint32 {
+	if atomic.LoadUint32(&cb.halfOpenToken) == StateCircuitBreakerHalfOpen {
+		return StateCircuitBreakerHalfOpen
+	}
+	return atomic.LoadUint32(&cb.state)
+}
+
 //SetCircuitBreakerPass 关闭状态：服务正常。
 func (cb *CircuitBreaker) SetCircuitBreakerPass() {
 	atomic.StoreUint32(&cb.state, StateCircuitBreakerClosed)
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+)
+
+//KeyedExecutor 按键保序的执行器，相同键的任务按提交顺序在同一协程中依次执行，不同键的任务并发执行。
+type KeyedExecutor struct {
+	queues []chan func()
+	mutex  sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+	logger *Logger
+}
+
+//NewKeyedExecutor 新建，workers为协程数，size为每个协程的队列长度。
+func NewKeyedExecutor(workers, size int) *KeyedExecutor {
+	if workers <= 0 {
+		workers = 1
+	}
+	logger, _ := NewLogger(ErrorLevel, "")
+	logger.SetMark("KeyedExecutor")
+	e := &KeyedExecutor{
+		queues: make([]chan func(), workers),
+		logger: logger,
+	}
+	for i := range e.queues {
+		e.queues[i] = make(chan func(), size)
+		e.wg.Add(1)
+		go e.run(e.queues[i])
+	}
+	return e
+}
+
+func (e *KeyedExecutor) run(queue chan func()) {
+	defer e.wg.Done()
+	for f := range queue {
+		e.execute(f)
+	}
+}
+
+//execute 执行，拦截异常
+func (e *KeyedExecutor) execute(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.logger.Error("execute|异常拦截：", r, string(debug.Stack()))
+		}
+	}()
+	f()
+}
+
+//Submit 提交任务，队列满时阻塞，已关闭时返回false。
+func (e *KeyedExecutor) Submit(key []byte, f func()) bool {
+	h := fnv.New32a()
+	h.Write(key)
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.closed {
+		return false
+	}
+	e.queues[h.Sum32()%uint32(len(e.queues))] <- f
+	return true
+}
+
+//Close 关闭，阻塞至已提交的任务执行完毕。
+func (e *KeyedExecutor) Close() {
+	e.mutex.Lock()
+	if !e.closed {
+		e.closed = true
+		for _, q := range e.queues {
+			close(q)
+		}
+	}
+	e.mutex.Unlock()
+	e.wg.Wait()
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_KeyedExecutor(t *testing.T) {
+	e := NewKeyedExecutor(4, 16)
+	var mutex sync.Mutex
+	seen := make(map[string][]int)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i % 10)
+		v := i
+		e.Submit([]byte(key), func() {
+			if v%7 == 0 {
+				time.Sleep(time.Microsecond)
+			}
+			if v == 500 {
+				panic("test")
+			}
+			mutex.Lock()
+			seen[key] = append(seen[key], v)
+			mutex.Unlock()
+		})
+	}
+	e.Close()
+	if e.Submit(nil, func() {}) {
+		t.Fatal("已关闭")
+	}
+	if len(seen) != 10 {
+		t.Fatal(len(seen))
+	}
+	for key, s := range seen {
+		for i := 1; i < len(s); i++ {
+			if s[i] <= s[i-1] {
+				t.Fatal(key, s)
+			}
+		}
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"time"
 )
 
+//limiterWaits 令牌不足时的等待次数
+var limiterWaits = DefaultMetrics.NewCounter("domi_limiter_waits_total", "Number of times the limiter blocked for lack of tokens.", "")
+
 //LimiterConfigure 限流器配置
 type LimiterConfigure struct {
 	LimitRate int64 //限流器速率，每秒处理的令牌数
@@ -25,10 +28,16 @@ type Limiter struct {
 	closeOnce sync.Once
 }
 
+//Tokens 当前令牌数
+func (l *Limiter) Tokens() int64 {
+	return atomic.LoadInt64(&l.tokens)
+}
+
 //Wait 阻塞等待
 func (l *Limiter) Wait(n int64) {
 	for atomic.AddInt64(&l.tokens, -n) < 0 {
 		atomic.AddInt64(&l.tokens, n)
+		limiterWaits.Inc()
 		time.Sleep(l.Snippet)
 	}
 }
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+//DefaultMetrics 进程内默认的指标注册表
+var DefaultMetrics = NewMetrics()
+
+//Metrics 指标注册表，以Prometheus文本格式输出。
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name, help, kind string
+	samples          map[string]func() float64 //标签 -> 取值函数
+}
+
+//NewMetrics 新建
+func NewMetrics() *Metrics {
+	return &Metrics{
+		families: make(map[string]*metricFamily, 32),
+	}
+}
+
+//Counter 计数器，只增不减。
+type Counter struct {
+	v uint64
+}
+
+//Inc 加1
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+//Add 加n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+//Get 读
+func (c *Counter) Get() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+//family 取得或新建指标族，需持有锁。
+func (m *Metrics) family(name, help, kind string) *metricFamily {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: kind, samples: make(map[string]func() float64, 4)}
+		m.families[name] = f
+	}
+	return f
+}
+
+//NewCounter 新建并注册计数器，labels 形如 `machine="1"`，可为空。
+func (m *Metrics) NewCounter(name, help, labels string) *Counter {
+	c := &Counter{}
+	m.mutex.Lock()
+	m.family(name, help, "counter").samples[labels] = func() float64 { return float64(c.Get()) }
+	m.mutex.Unlock()
+	return c
+}
+
+//SetGauge 注册仪表，f 在输出时调用，需线程安全。
+func (m *Metrics) SetGauge(name, help, labels string, f func() float64) {
+	m.mutex.Lock()
+	m.family(name, help, "gauge").samples[labels] = f
+	m.mutex.Unlock()
+}
+
+//Remove 注销指标
+func (m *Metrics) Remove(name, labels string) {
+	m.mutex.Lock()
+	if f, ok := m.families[name]; ok {
+		delete(f.samples, labels)
+		if len(f.samples) == 0 {
+			delete(m.families, name)
+		}
+	}
+	m.mutex.Unlock()
+}
+
+//WriteTo 以Prometheus文本格式输出，按名称及标签排序。
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.families))
+	for k := range m.families {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var bw bytes.Buffer
+	for _, name := range names {
+		f := m.families[name]
+		bw.WriteString("# HELP " + f.name + " " + f.help + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+		labels := make([]string, 0, len(f.samples))
+		for k := range f.samples {
+			labels = append(labels, k)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			bw.WriteString(f.name)
+			if l != "" {
+				bw.WriteString("{" + l + "}")
+			}
+			bw.WriteString(" " + strconv.FormatFloat(f.samples[l](), 'g', -1, 64) + "\n")
+		}
+	}
+	m.mutex.Unlock()
+	n, err := w.Write(bw.Bytes())
+	return int64(n), err
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Metrics(t *testing.T) {
+	m := NewMetrics()
+	c := m.NewCounter("test_total", "Test counter.", "")
+	c.Inc()
+	c.Add(2)
+	v := 1.5
+	m.SetGauge("test_gauge", "Test gauge.", `machine="2"`, func() float64 { return v })
+	m.SetGauge("test_gauge", "Test gauge.", `machine="1"`, func() float64 { return 7 })
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	want := `# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge{machine="1"} 7
+test_gauge{machine="2"} 1.5
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total 3
+`
+	if buf.String() != want {
+		t.Fatal(buf.String())
+	}
+	m.Remove("test_gauge", `machine="1"`)
+	m.Remove("test_gauge", `machine="2"`)
+	buf.Reset()
+	m.WriteTo(&buf)
+	if bytes.Contains(buf.Bytes(), []byte("test_gauge")) {
+		t.Fatal(buf.String())
+	}
+}
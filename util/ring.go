@@ -95,6 +95,16 @@ func (r *RingBuffer) SetAvailableCursor(val uint64) {
 	atomic.StoreUint64(&r.availableCursor, val)
 }
 
+//Len 已写入未消费的字节数
+func (r *RingBuffer) Len() uint64 {
+	return atomic.LoadUint64(&r.askCursor) - atomic.LoadUint64(&r.availableCursor)
+}
+
+//Cap 容量
+func (r *RingBuffer) Cap() uint64 {
+	return r.ringBufferSize
+}
+
 //HasWork 是否工作
 func (r *RingBuffer) HasWork() bool {
 	return atomic.LoadUint32(&r.state) == StateWork
@@ -0,0 +1,173 @@
+package util
+
+import (
+	"container/list"
+	"time"
+)
+
+//wheelBits 每层64个槽
+const (
+	wheelBits  = 6
+	wheelSlots = 1 << wheelBits
+	wheelMask  = wheelSlots - 1
+)
+
+//TimingWheel 分层时间轮，第k层每个槽的跨度为 Tick*64^k，超出范围的定时器放在最高层，逐层下降。
+//线程不安全，由单一协程调用。
+type TimingWheel struct {
+	tick    time.Duration
+	start   time.Time
+	current int64 //已推进的刻度数
+	levels  [][]*list.List
+	timers  map[uint64]*wheelTimer
+}
+
+type wheelTimer struct {
+	id     uint64
+	expire int64 //到期刻度
+	f      func()
+	slot   *list.List
+	elem   *list.Element
+}
+
+//NewTimingWheel 新建，tick为精度，levels为层数，可表示的范围为 tick*64^levels。
+func NewTimingWheel(tick time.Duration, levels int, start time.Time) *TimingWheel {
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+	if levels <= 0 {
+		levels = 4
+	}
+	tw := &TimingWheel{
+		tick:   tick,
+		start:  start,
+		levels: make([][]*list.List, levels),
+		timers: make(map[uint64]*wheelTimer, 1024),
+	}
+	for i := range tw.levels {
+		tw.levels[i] = make([]*list.List, wheelSlots)
+		for j := range tw.levels[i] {
+			tw.levels[i][j] = list.New()
+		}
+	}
+	return tw
+}
+
+//Add 加入定时器，到期时由Advance调用f，id已存在时替换。已过期的在下一刻度调用。
+func (tw *TimingWheel) Add(id uint64, at time.Time, f func()) {
+	tw.Remove(id)
+	expire := int64(at.Sub(tw.start) / tw.tick)
+	if at.Sub(tw.start)%tw.tick != 0 {
+		expire++
+	}
+	if expire <= tw.current {
+		expire = tw.current + 1
+	}
+	t := &wheelTimer{id: id, expire: expire, f: f}
+	tw.timers[id] = t
+	tw.place(t)
+}
+
+//place 按剩余刻度放入对应层的槽
+func (tw *TimingWheel) place(t *wheelTimer) {
+	delta := t.expire - tw.current
+	level := 0
+	for level < len(tw.levels)-1 && delta >= int64(1)<<(uint(level+1)*wheelBits) {
+		level++
+	}
+	slot := (t.expire >> (uint(level) * wheelBits)) & wheelMask
+	//超出范围时放在最高层当前位置的前一个槽，绕一圈后重新放置。
+	if delta >= int64(1)<<(uint(level+1)*wheelBits) {
+		slot = ((tw.current >> (uint(level) * wheelBits)) - 1) & wheelMask
+	}
+	t.slot = tw.levels[level][slot]
+	t.elem = t.slot.PushBack(t)
+}
+
+//Remove 移除定时器
+func (tw *TimingWheel) Remove(id uint64) bool {
+	t, ok := tw.timers[id]
+	if !ok {
+		return false
+	}
+	t.slot.Remove(t.elem)
+	delete(tw.timers, id)
+	return true
+}
+
+//Len 定时器数量
+func (tw *TimingWheel) Len() int {
+	return len(tw.timers)
+}
+
+//nextTick 下一个有定时器到期或需要下降的刻度，不晚于最早的到期刻度。
+func (tw *TimingWheel) nextTick() (int64, bool) {
+	if len(tw.timers) == 0 {
+		return 0, false
+	}
+	next := int64(-1)
+	for level := range tw.levels {
+		shift := uint(level) * wheelBits
+		base := tw.current >> shift
+		//更高层最早的刻度也不早于已找到的
+		if next >= 0 && (base+1)<<shift >= next {
+			break
+		}
+		//从下一个槽起扫描一圈，当前槽放在最后
+		for k := int64(1); k <= wheelSlots; k++ {
+			if tw.levels[level][(base+k)&wheelMask].Len() > 0 {
+				if tick := (base + k) << shift; next < 0 || tick < next {
+					next = tick
+				}
+				break
+			}
+		}
+	}
+	return next, next >= 0
+}
+
+//NextExpire 下一次需要调用Advance的时间，不晚于最早的到期时间，没有定时器时ok为false。
+func (tw *TimingWheel) NextExpire() (time.Time, bool) {
+	next, ok := tw.nextTick()
+	if !ok {
+		return time.Time{}, false
+	}
+	return tw.start.Add(time.Duration(next) * tw.tick), true
+}
+
+//Advance 推进到now，按到期顺序调用到期的定时器，跳过没有定时器到期或下降的刻度。
+func (tw *TimingWheel) Advance(now time.Time) {
+	target := int64(now.Sub(tw.start) / tw.tick)
+	for tw.current < target {
+		next, ok := tw.nextTick()
+		if !ok || next > target {
+			tw.current = target
+			return
+		}
+		tw.current = next
+		//高层的槽到达时逐层下降
+		for level := 1; level < len(tw.levels); level++ {
+			if tw.current&(int64(1)<<(uint(level)*wheelBits)-1) != 0 {
+				break
+			}
+			slot := tw.levels[level][(tw.current>>(uint(level)*wheelBits))&wheelMask]
+			for e := slot.Front(); e != nil; {
+				next := e.Next()
+				t := slot.Remove(e).(*wheelTimer)
+				tw.place(t)
+				e = next
+			}
+		}
+		slot := tw.levels[0][tw.current&wheelMask]
+		for e := slot.Front(); e != nil; e = slot.Front() {
+			t := slot.Remove(e).(*wheelTimer)
+			//只有一层时超出范围的定时器在此重新放置
+			if t.expire > tw.current {
+				tw.place(t)
+				continue
+			}
+			delete(tw.timers, t.id)
+			t.f()
+		}
+	}
+}
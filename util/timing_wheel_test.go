@@ -0,0 +1,94 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TimingWheel(t *testing.T) {
+	start := time.Now()
+	tw := NewTimingWheel(time.Millisecond, 3, start)
+	var fired []uint64
+	add := func(id uint64, d time.Duration) {
+		tw.Add(id, start.Add(d), func() { fired = append(fired, id) })
+	}
+	//跨越各层及超出范围
+	add(1, 5*time.Millisecond)
+	add(2, 70*time.Millisecond)
+	add(3, 5000*time.Millisecond)
+	add(4, 300000*time.Millisecond)
+	add(5, 70*time.Millisecond)
+	add(6, -time.Millisecond)
+	if !tw.Remove(5) || tw.Remove(5) || tw.Len() != 5 {
+		t.Fatal(tw.Len())
+	}
+	tw.Advance(start.Add(time.Millisecond))
+	if len(fired) != 1 || fired[0] != 6 {
+		t.Fatal(fired)
+	}
+	tw.Advance(start.Add(69 * time.Millisecond))
+	if len(fired) != 2 || fired[1] != 1 {
+		t.Fatal(fired)
+	}
+	tw.Advance(start.Add(70 * time.Millisecond))
+	if len(fired) != 3 || fired[2] != 2 {
+		t.Fatal(fired)
+	}
+	tw.Advance(start.Add(4999 * time.Millisecond))
+	if len(fired) != 3 {
+		t.Fatal(fired)
+	}
+	tw.Advance(start.Add(5000 * time.Millisecond))
+	if len(fired) != 4 || fired[3] != 3 {
+		t.Fatal(fired)
+	}
+	tw.Advance(start.Add(299999 * time.Millisecond))
+	if len(fired) != 4 || tw.Len() != 1 {
+		t.Fatal(fired)
+	}
+	tw.Advance(start.Add(300000 * time.Millisecond))
+	if len(fired) != 5 || fired[4] != 4 || tw.Len() != 0 {
+		t.Fatal(fired)
+	}
+}
+
+func Test_TimingWheelNextExpire(t *testing.T) {
+	start := time.Now()
+	tw := NewTimingWheel(time.Millisecond, 4, start)
+	if _, ok := tw.NextExpire(); ok {
+		t.Fatal("空的时间轮")
+	}
+	//空闲很久后推进，直接跳到目标刻度
+	tw.Advance(start.Add(1000 * time.Hour))
+	if tw.current != int64(1000*time.Hour/time.Millisecond) {
+		t.Fatal(tw.current)
+	}
+	base := start.Add(1000 * time.Hour)
+	var fired []time.Duration
+	for i, d := range []time.Duration{3 * time.Millisecond, 90 * time.Millisecond, 100 * time.Hour, 7 * time.Second} {
+		d := d
+		tw.Add(uint64(i), base.Add(d), func() { fired = append(fired, d) })
+	}
+	//按NextExpire休眠推进，次数与定时器及层数相关，与刻度数无关。
+	steps := 0
+	for {
+		at, ok := tw.NextExpire()
+		if !ok {
+			break
+		}
+		if at.Before(base) {
+			t.Fatal(at)
+		}
+		tw.Advance(at)
+		steps++
+		if steps > 1000 {
+			t.Fatal("推进次数过多")
+		}
+	}
+	if len(fired) != 4 || fired[0] != 3*time.Millisecond || fired[1] != 90*time.Millisecond || fired[2] != 7*time.Second || fired[3] != 100*time.Hour {
+		t.Fatal(fired)
+	}
+	if tw.current != int64((1100*time.Hour)/time.Millisecond) {
+		t.Fatal(tw.current)
+	}
+}
@@ -0,0 +1,389 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//定义WAL刷盘策略
+const (
+	SyncAlways   uint8 = iota //每次写入后刷盘
+	SyncInterval              //按时间间隔刷盘
+	SyncNever                 //由操作系统决定
+)
+
+//定义错误
+var (
+	ErrWALClosed  = errors.New("util.WAL|已关闭。")
+	ErrWALOffset  = errors.New("util.WAL.Read|偏移量超出范围。")
+	ErrWALCorrupt = errors.New("util.WAL.Read|记录校验失败。")
+	ErrWALName    = errors.New("util.WAL.Commit|消费者名称无效。")
+)
+
+const (
+	walHeadLength = 8 //记录头：4字节长度、4字节crc32
+	walSuffix     = ".wal"
+	offsetSuffix  = ".offset"
+)
+
+//WALConfigure 预写日志配置
+type WALConfigure struct {
+	Dir           string        //目录
+	SegmentSize   int64         //段文件大小上限，默认64MB
+	SyncPolicy    uint8         //刷盘策略，默认SyncAlways
+	SyncInterval  time.Duration //SyncInterval策略的刷盘间隔，默认1秒
+	RetentionSize int64         //保留的总大小，0不限
+	RetentionAge  time.Duration //保留时间，0不限
+}
+
+//walSegment 段文件，文件名为第一条记录的偏移量。
+type walSegment struct {
+	base    uint64
+	file    *os.File
+	size    int64
+	index   []int64 //各记录在文件中的位置
+	modTime time.Time
+}
+
+//WAL 分段的只追加日志，记录按偏移量（从0递增）读取。
+type WAL struct {
+	WALConfigure
+	mutex    sync.RWMutex
+	segments []*walSegment
+	dirty    bool //有未刷盘的写入
+	closed   bool
+	stopChan chan struct{}
+}
+
+//OpenWAL 打开或新建，末尾不完整的记录将被截断。
+func OpenWAL(c WALConfigure) (*WAL, error) {
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = 64 << 20
+	}
+	if c.SyncInterval <= 0 {
+		c.SyncInterval = time.Second
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, errors.New("OpenWAL|" + err.Error())
+	}
+	names, err := filepath.Glob(filepath.Join(c.Dir, "*"+walSuffix))
+	if err != nil {
+		return nil, errors.New("OpenWAL|" + err.Error())
+	}
+	sort.Strings(names)
+	w := &WAL{
+		WALConfigure: c,
+		segments:     make([]*walSegment, 0, len(names)+1),
+		stopChan:     make(chan struct{}),
+	}
+	for i, name := range names {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, err := openSegment(name, base, i == len(names)-1)
+		if err != nil {
+			w.closeFiles()
+			return nil, err
+		}
+		w.segments = append(w.segments, seg)
+	}
+	if len(w.segments) == 0 {
+		if err := w.roll(0); err != nil {
+			return nil, err
+		}
+	}
+	if c.SyncPolicy == SyncInterval {
+		go w.run()
+	}
+	return w, nil
+}
+
+//openSegment 打开段文件并建立索引，last为最后一个段时截断不完整的记录。
+func openSegment(name string, base uint64, last bool) (*walSegment, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.New("openSegment|" + err.Error())
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.New("openSegment|" + err.Error())
+	}
+	seg := &walSegment{base: base, file: f, modTime: fi.ModTime()}
+	head := make([]byte, walHeadLength)
+	for {
+		if _, err := f.ReadAt(head, seg.size); err != nil {
+			break
+		}
+		l := int64(binary.LittleEndian.Uint32(head[:4]))
+		if seg.size+walHeadLength+l > fi.Size() {
+			break
+		}
+		data := make([]byte, l)
+		if _, err := f.ReadAt(data, seg.size+walHeadLength); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(head[4:]) {
+			break
+		}
+		seg.index = append(seg.index, seg.size)
+		seg.size += walHeadLength + l
+	}
+	if last && seg.size < fi.Size() {
+		if err := f.Truncate(seg.size); err != nil {
+			f.Close()
+			return nil, errors.New("openSegment|截断失败：" + err.Error())
+		}
+	}
+	return seg, nil
+}
+
+//roll 新建段文件，需持有锁。
+func (w *WAL) roll(base uint64) error {
+	name := filepath.Join(w.Dir, fmt.Sprintf("%020d%s", base, walSuffix))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.New("roll|" + err.Error())
+	}
+	w.segments = append(w.segments, &walSegment{base: base, file: f, modTime: time.Now()})
+	return nil
+}
+
+//Append 追加记录，返回偏移量。
+func (w *WAL) Append(data []byte) (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return 0, ErrWALClosed
+	}
+	seg := w.segments[len(w.segments)-1]
+	l := int64(walHeadLength + len(data))
+	if seg.size > 0 && seg.size+l > w.SegmentSize {
+		if err := seg.file.Sync(); err != nil {
+			return 0, errors.New("Append|" + err.Error())
+		}
+		if err := w.roll(seg.base + uint64(len(seg.index))); err != nil {
+			return 0, err
+		}
+		w.retain()
+		seg = w.segments[len(w.segments)-1]
+	}
+	buf := make([]byte, l)
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[walHeadLength:], data)
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		return 0, errors.New("Append|" + err.Error())
+	}
+	offset := seg.base + uint64(len(seg.index))
+	seg.index = append(seg.index, seg.size)
+	seg.size += l
+	seg.modTime = time.Now()
+	if w.SyncPolicy == SyncAlways {
+		if err := seg.file.Sync(); err != nil {
+			return offset, errors.New("Append|" + err.Error())
+		}
+	} else {
+		w.dirty = true
+	}
+	return offset, nil
+}
+
+//Read 按偏移量读取记录
+func (w *WAL) Read(offset uint64) ([]byte, error) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	i := sort.Search(len(w.segments), func(i int) bool { return w.segments[i].base > offset }) - 1
+	if i < 0 {
+		return nil, ErrWALOffset
+	}
+	seg := w.segments[i]
+	if offset-seg.base >= uint64(len(seg.index)) {
+		return nil, ErrWALOffset
+	}
+	pos := seg.index[offset-seg.base]
+	head := make([]byte, walHeadLength)
+	if _, err := seg.file.ReadAt(head, pos); err != nil {
+		return nil, errors.New("Read|" + err.Error())
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(head[:4]))
+	if _, err := seg.file.ReadAt(data, pos+walHeadLength); err != nil {
+		return nil, errors.New("Read|" + err.Error())
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(head[4:]) {
+		return nil, ErrWALCorrupt
+	}
+	return data, nil
+}
+
+//Offsets 最早一条记录的偏移量及下一条写入的偏移量，两者相等时为空。
+func (w *WAL) Offsets() (uint64, uint64) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	last := w.segments[len(w.segments)-1]
+	return w.segments[0].base, last.base + uint64(len(last.index))
+}
+
+//Size 所有段文件的大小
+func (w *WAL) Size() int64 {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	var n int64
+	for _, seg := range w.segments {
+		n += seg.size
+	}
+	return n
+}
+
+//Retain 按大小及时间删除过期的段文件，正在写入的段文件不删除。
+func (w *WAL) Retain() {
+	w.mutex.Lock()
+	w.retain()
+	w.mutex.Unlock()
+}
+
+//retain 需持有锁
+func (w *WAL) retain() {
+	if w.RetentionSize <= 0 && w.RetentionAge <= 0 {
+		return
+	}
+	var total int64
+	for _, seg := range w.segments {
+		total += seg.size
+	}
+	for len(w.segments) > 1 {
+		seg := w.segments[0]
+		overSize := w.RetentionSize > 0 && total > w.RetentionSize
+		overAge := w.RetentionAge > 0 && time.Since(seg.modTime) > w.RetentionAge
+		if !overSize && !overAge {
+			return
+		}
+		seg.file.Close()
+		os.Remove(seg.file.Name())
+		total -= seg.size
+		w.segments = w.segments[1:]
+	}
+}
+
+//Trim 删除记录全部小于offset的段文件，正在写入的段文件不删除。
+func (w *WAL) Trim(offset uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(w.segments) > 1 && w.segments[1].base <= offset {
+		seg := w.segments[0]
+		seg.file.Close()
+		os.Remove(seg.file.Name())
+		w.segments = w.segments[1:]
+	}
+}
+
+//Sync 刷盘
+func (w *WAL) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.sync()
+}
+
+//sync 需持有锁
+func (w *WAL) sync() error {
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.segments[len(w.segments)-1].file.Sync()
+}
+
+//run SyncInterval策略定时刷盘
+func (w *WAL) run() {
+	ticker := time.NewTicker(w.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Sync()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+//Commit 记录消费者下一条待消费的偏移量，重启后由Committed读取。
+func (w *WAL) Commit(name string, offset uint64) error {
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return ErrWALName
+	}
+	path := filepath.Join(w.Dir, name+offsetSuffix)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.New("Commit|" + err.Error())
+	}
+	_, err = f.WriteString(strconv.FormatUint(offset, 10))
+	if err == nil && w.SyncPolicy == SyncAlways {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.New("Commit|" + err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.New("Commit|" + err.Error())
+	}
+	return nil
+}
+
+//Committed 读取消费者已提交的偏移量，未提交时返回0。
+func (w *WAL) Committed(name string) (uint64, error) {
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return 0, ErrWALName
+	}
+	b, err := ioutil.ReadFile(filepath.Join(w.Dir, name+offsetSuffix))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.New("Committed|" + err.Error())
+	}
+	offset, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, errors.New("Committed|" + err.Error())
+	}
+	return offset, nil
+}
+
+//Close 刷盘并关闭
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	err := w.sync()
+	w.closed = true
+	close(w.stopChan)
+	w.closeFiles()
+	return err
+}
+
+//closeFiles 关闭段文件
+func (w *WAL) closeFiles() {
+	for _, seg := range w.segments {
+		seg.file.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_WAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := WALConfigure{Dir: dir, SegmentSize: 64}
+	w, err := OpenWAL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		offset, err := w.Append([]byte(fmt.Sprintf("record%d", i)))
+		if err != nil || offset != uint64(i) {
+			t.Fatal(offset, err)
+		}
+	}
+	//每个段文件可容纳4条记录
+	if names, _ := filepath.Glob(filepath.Join(dir, "*.wal")); len(names) != 3 {
+		t.Fatal("段文件数量:", names)
+	}
+	if err := w.Commit("c1", 6); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	//模拟写入中断
+	f, _ := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d.wal", 8)), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{20, 0, 0, 0, 1, 2})
+	f.Close()
+	w, err = OpenWAL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, next := w.Offsets(); first != 0 || next != 10 {
+		t.Fatal(first, next)
+	}
+	for i := 0; i < 10; i++ {
+		data, err := w.Read(uint64(i))
+		if err != nil || string(data) != fmt.Sprintf("record%d", i) {
+			t.Fatal(i, string(data), err)
+		}
+	}
+	if _, err := w.Read(10); err != ErrWALOffset {
+		t.Fatal(err)
+	}
+	if offset, err := w.Committed("c1"); err != nil || offset != 6 {
+		t.Fatal(offset, err)
+	}
+	if offset, err := w.Committed("c2"); err != nil || offset != 0 {
+		t.Fatal(offset, err)
+	}
+	if offset, err := w.Append([]byte("record10")); err != nil || offset != 10 {
+		t.Fatal(offset, err)
+	}
+	//按大小保留
+	w.RetentionSize = 110
+	w.Retain()
+	if first, next := w.Offsets(); first != 4 || next != 11 || w.Size() != 106 {
+		t.Fatal(first, next, w.Size())
+	}
+	if _, err := w.Read(3); err != ErrWALOffset {
+		t.Fatal(err)
+	}
+	//按时间保留
+	w.RetentionSize = 0
+	w.RetentionAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	w.Retain()
+	if first, next := w.Offsets(); first != 8 || next != 11 {
+		t.Fatal(first, next)
+	}
+	w.Close()
+	if _, err := w.Append(nil); err != ErrWALClosed {
+		t.Fatal(err)
+	}
+}
@@ -3,9 +3,13 @@ package util
 import (
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//dispatcherJobs 调度者接收的任务数
+var dispatcherJobs = DefaultMetrics.NewCounter("domi_dispatcher_jobs_total", "Number of jobs received by dispatchers.", "")
+
 //MaxQueue 队列最大缓存数
 const MaxQueue = 2048
 
@@ -51,6 +55,7 @@ func (w *Worker) run() {
 type Dispatcher struct {
 	JobQueue chan Job //任务队列
 	jobSlice []Job    //任务切片
+	backlog  int64    //任务切片长度	原子操作
 
 	workerQueue     chan chan Job //空闲工作者队列
 	workerPool      []chan Job    //空闲工作者池
@@ -95,8 +100,11 @@ func (d *Dispatcher) Run() {
 			d.workerPool = append(d.workerPool, jj)
 		case j := <-d.JobQueue:
 			d.jobSlice = append(d.jobSlice, j)
+			dispatcherJobs.Inc()
+			atomic.StoreInt64(&d.backlog, int64(len(d.jobSlice)))
 		case <-snippet.C:
 			d.assignmentTask()
+			atomic.StoreInt64(&d.backlog, int64(len(d.jobSlice)))
 		case <-d.stopChan:
 			d.logger.Debug("Run|等待工作者关闭……")
 			snippet.Stop()
@@ -123,6 +131,11 @@ func (d *Dispatcher) Run() {
 	}
 }
 
+//Len 等待分配的任务数
+func (d *Dispatcher) Len() int {
+	return len(d.JobQueue) + int(atomic.LoadInt64(&d.backlog))
+}
+
 //Close 关闭
 func (d *Dispatcher) Close() {
 	d.closeOnce.Do(func() {